@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"RubCourse/ehall"
+)
+
+// courtState 是一个场地在某个时间段的状态
+type courtState struct {
+	Name      string
+	Available bool
+	Text      string
+}
+
+// availability 是某天某个时间段所有场地状态的快照, 一次 getOpeningRoom.do 得到
+type availability struct {
+	mu sync.Mutex
+	// 时间段本身是否可以预约, 来自 getTimeList.do
+	slotOpen  bool
+	courts    map[string]courtState
+	fetchedAt time.Time
+}
+
+// Free 判断场地在快照中是否空闲
+func (a *availability) Free(courtId string) bool {
+	return a.slotOpen && a.courts[courtId].Available
+}
+
+// Courts 返回快照中的所有场地, 按名字排序. 场地列表获取不到时用它代替
+func (a *availability) Courts() []Badminton {
+	courts := make([]Badminton, 0, len(a.courts))
+	for id, c := range a.courts {
+		courts = append(courts, Badminton{Id: id, Name: c.Name})
+	}
+	sort.Slice(courts, func(i, j int) bool { return courts[i].Name < courts[j].Name })
+	return courts
+}
+
+// freeCount 返回快照中空闲场地的数量
+func (a *availability) freeCount() int {
+	if !a.slotOpen {
+		return 0
+	}
+	n := 0
+	for _, c := range a.courts {
+		if c.Available {
+			n++
+		}
+	}
+	return n
+}
+
+// timeList 是某天所有时间段的状态, 一次 getTimeList.do 得到
+type timeList struct {
+	mu        sync.Mutex
+	kyy       []ehall.KYY
+	fetchedAt time.Time
+}
+
+// availabilityCache 按场馆、项目、校区、日期和时间段保存快照, 所有任务共用
+type availabilityCache struct {
+	mu        sync.Mutex
+	snapshots map[string]*availability
+	// 按校区、项目和日期保存的时间段状态
+	timeLists map[string]*timeList
+}
+
+var availabilities = newAvailabilityCache()
+
+func newAvailabilityCache() *availabilityCache {
+	return &availabilityCache{
+		snapshots: make(map[string]*availability),
+		timeLists: make(map[string]*timeList),
+	}
+}
+
+// TimeList 返回某天所有时间段的状态, 超过 maxAge 时重新查询, 同一天同时只查询一次
+func (c *availabilityCache) TimeList(ctx context.Context, user *UserInfo, date string, maxAge time.Duration) ([]ehall.KYY, error) {
+	place := user.Place.WithDefaults()
+	key := fmt.Sprintf("%s/%s %s", place.Campus, place.Sport, date)
+	c.mu.Lock()
+	t, ok := c.timeLists[key]
+	if !ok {
+		t = &timeList{}
+		c.timeLists[key] = t
+	}
+	c.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fetchedAt.IsZero() || time.Since(t.fetchedAt) >= maxAge {
+		fmt.Println("YYRQ", date)
+		kyy, err := ehallClient(user).GetTimeList(ctx, date, place)
+		if err != nil {
+			return nil, ehallError(ctx, err)
+		}
+		t.kyy = kyy
+		t.fetchedAt = time.Now()
+	}
+	return t.kyy, nil
+}
+
+// slotOpen 判断时间段在 getTimeList.do 的结果中是否还可以预约
+func slotOpen(kyy []ehall.KYY, slot ehall.Slot) bool {
+	for _, v := range kyy {
+		if v.CODE == slot.KYYSJD() && v.Available() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *availabilityCache) snapshot(place ehall.Place, slot ehall.Slot) *availability {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	place = place.WithDefaults()
+	key := fmt.Sprintf("%s/%s/%s %s %s", place.Campus, place.Venue, place.Sport, slot.Date, slot.KYYSJD())
+	a, ok := c.snapshots[key]
+	if !ok {
+		a = &availability{}
+		c.snapshots[key] = a
+	}
+	return a
+}
+
+// Get 返回时间段的场地状态. 快照超过 config.AvailabilityRefresh 或者没有空闲场地时重新查询,
+// 同一个时间段同时只查询一次. 返回的是副本
+func (c *availabilityCache) Get(ctx context.Context, user *UserInfo, slot ehall.Slot) (*availability, error) {
+	a := c.snapshot(user.Place, slot)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.fetchedAt.IsZero() || a.freeCount() == 0 || time.Since(a.fetchedAt) >= config.availabilityRefresh() {
+		// 任务每轮刚查过的时间段状态可以直接用
+		kyy, err := c.TimeList(ctx, user, slot.Date, config.availabilityRefresh())
+		if err != nil {
+			return nil, err
+		}
+		if err := a.refresh(ctx, kyy, user, slot); err != nil {
+			return nil, err
+		}
+	}
+
+	courts := make(map[string]courtState, len(a.courts))
+	for id, state := range a.courts {
+		courts[id] = state
+	}
+	return &availability{slotOpen: a.slotOpen, courts: courts, fetchedAt: a.fetchedAt}, nil
+}
+
+// MarkTaken 在快照中把场地标记为不可预约, 下次刷新前不再尝试
+func (c *availabilityCache) MarkTaken(place ehall.Place, slot ehall.Slot, courtId string) {
+	a := c.snapshot(place, slot)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if state, ok := a.courts[courtId]; ok {
+		state.Available = false
+		a.courts[courtId] = state
+	}
+}
+
+// refresh 时间段可以预约时查询任务场馆中所有场地的状态
+func (a *availability) refresh(ctx context.Context, kyy []ehall.KYY, user *UserInfo, slot ehall.Slot) error {
+	place := user.Place.WithDefaults()
+	open := slotOpen(kyy, slot)
+
+	courts := make(map[string]courtState)
+	if open {
+		// time is suitable, and then check the CD if suitable
+		rows, err := ehallClient(user).GetOpeningRoom(ctx, slot, place)
+		if err != nil {
+			return ehallError(ctx, err)
+		}
+		catalog.RecordPlaces(rows)
+		for _, v := range rows {
+			// 同一个项目和校区可能返回多个场馆的场地
+			if v.CGBM != "" && v.CGBM != place.Venue {
+				continue
+			}
+			courts[v.WID] = courtState{Name: v.CDMC, Available: v.Available(), Text: v.Text}
+		}
+	}
+
+	a.slotOpen = open
+	a.courts = courts
+	a.fetchedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"RubCourse/ehall"
+)
+
+func newBooking(user *UserInfo, court Badminton, slot ehall.Slot) ehall.Booking {
+	return ehall.Booking{
+		UserId:      user.UserId,
+		UserName:    user.UserName,
+		PhoneNumber: user.PhoneNumber,
+		// 场地ID, 不固定, 需要读取JSON文件
+		CDWID: court.Id,
+		Slot:  slot,
+		Place: user.Place,
+	}
+}
+
+// insertCtxKey 保存预约请求使用的 context, 见 withInsertContext
+type insertCtxKey struct{}
+
+// withInsertContext 让 ctx 中发出的预约请求随 parent 取消. 满足完成条件后取消 ctx 只是不再提交新的预约,
+// 已经发出的请求服务器可能已经处理了, 等它们完成; 任务取消 (parent 取消) 时才中断它们
+func withInsertContext(ctx, parent context.Context) context.Context {
+	return context.WithValue(ctx, insertCtxKey{}, parent)
+}
+
+// insertContext 返回 ctx 中发出的预约请求使用的 context, 没有设置时就是 ctx
+func insertContext(ctx context.Context) context.Context {
+	if parent, ok := ctx.Value(insertCtxKey{}).(context.Context); ok {
+		return parent
+	}
+	return ctx
+}
+
+// insertResult 是向一个场地提交预约的结果
+type insertResult struct {
+	court Badminton
+	err   error
+}
+
+// insertCourts 同时向 courts 提交预约, 最多 config.InsertWorkers 个请求同时进行.
+// 一个成功后取消其他还没完成的请求, 也不再提交剩下的场地; ctx 取消后不再提交, 已经发出的请求见 withInsertContext.
+// 返回预约成功的场地, 几个请求几乎同时成功时返回多个
+func insertCourts(ctx context.Context, user *UserInfo, slot ehall.Slot, courts []Badminton) ([]Badminton, error) {
+	attemptCtx, cancel := context.WithCancel(insertContext(ctx))
+	defer cancel()
+	// 满足完成条件或者已经预约成功后, 不再提交还没有分配的场地
+	stopped := func() bool { return ctx.Err() != nil || attemptCtx.Err() != nil }
+
+	workers := config.InsertWorkers
+	if workers > len(courts) {
+		workers = len(courts)
+	}
+
+	jobs := make(chan Badminton)
+	results := make(chan insertResult, len(courts))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for court := range jobs {
+				if stopped() {
+					return
+				}
+				results <- insertResult{court, insertCourt(attemptCtx, user, court, slot)}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, court := range courts {
+			select {
+			case jobs <- court:
+			case <-ctx.Done():
+				return
+			case <-attemptCtx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// 等所有请求都结束再返回, 按 登录失效 > 服务器拒绝 > 网络错误 的顺序报告失败原因
+	var booked []Badminton
+	var authErr, rejectedErr, otherErr error
+	for result := range results {
+		switch err := result.err; {
+		case err == nil:
+			booked = append(booked, result.court)
+			cancel()
+		case errors.Is(err, context.Canceled):
+		case errors.Is(err, errAuthExpired):
+			authErr = err
+		case errors.Is(err, errRejected):
+			rejectedErr = err
+		default:
+			otherErr = err
+		}
+	}
+
+	switch {
+	case len(booked) > 0:
+		return booked, nil
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case authErr != nil:
+		return nil, authErr
+	case rejectedErr != nil:
+		return nil, rejectedErr
+	case otherErr != nil:
+		return nil, otherErr
+	}
+	return nil, errSlotGone
+}
+
+// insertCourt 向一个场地提交预约
+func insertCourt(ctx context.Context, user *UserInfo, court Badminton, slot ehall.Slot) error {
+	result, err := ehallClient(user).InsertVenueBookingInfo(ctx, newBooking(user, court, slot))
+	if err != nil {
+		return ehallError(ctx, err)
+	}
+	// 成功或被拒绝的场地都不用再试, 等快照刷新
+	availabilities.MarkTaken(user.Place, slot, court.Id)
+
+	if !result.Success {
+		fmt.Println("ERROR: ", court.Name, result.Body)
+		if result.Msg != "" {
+			return fmt.Errorf("%w: %s", errRejected, result.Msg)
+		}
+		return fmt.Errorf("%w: %s", errRejected, result.Body)
+	}
+	fmt.Println(court.Name, result.Body, "OK!")
+	return nil
+}
@@ -0,0 +1,84 @@
+// Package cas 实现深大统一身份认证 (authserver.szu.edu.cn) 的登录
+package cas
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// PasswordEncryptor 加密登录密码, salt 是登录页 pwdEncryptSalt 的值
+type PasswordEncryptor interface {
+	Encrypt(password, salt string) (string, error)
+}
+
+// 登录页 encrypt.js 中 _rds 使用的字符
+const randomChars = "ABCDEFGHJKMNPQRSTWXYZabcdefhijkmnprstwxyz2345678"
+
+// AESEncryptor 和登录页 encrypt.js 的 encryptAES 一致:
+// 在密码前加 64 个随机字符, 用 salt 作为 key, 16 个随机字符作为 iv, AES-CBC + PKCS7 加密后 base64
+type AESEncryptor struct {
+	// Rand 为空时使用 crypto/rand
+	Rand io.Reader
+}
+
+func (e AESEncryptor) Encrypt(password, salt string) (string, error) {
+	if salt == "" {
+		return password, nil
+	}
+
+	// 和 encrypt.js 的参数求值顺序一致, 先生成前缀再生成 iv
+	prefix, err := e.randomString(64)
+	if err != nil {
+		return "", err
+	}
+	iv, err := e.randomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher([]byte(strings.TrimSpace(salt)))
+	if err != nil {
+		return "", fmt.Errorf("pwdEncryptSalt: %w", err)
+	}
+
+	plaintext := pkcs7Pad([]byte(prefix+password), aes.BlockSize)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, []byte(iv)).CryptBlocks(ciphertext, plaintext)
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// randomString 从 randomChars 中均匀地取 n 个字符
+func (e AESEncryptor) randomString(n int) (string, error) {
+	r := e.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+
+	// 丢弃 >= limit 的字节, 避免取模带来的偏差
+	limit := byte(256 - 256%len(randomChars))
+	out := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(out) < n {
+		chunk := buf[:n-len(out)]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return "", fmt.Errorf("random: %w", err)
+		}
+		for _, b := range chunk {
+			if b < limit {
+				out = append(out, randomChars[int(b)%len(randomChars)])
+			}
+		}
+	}
+	return string(out), nil
+}
+
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	padding := blockSize - len(data)%blockSize
+	return append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+}
@@ -0,0 +1,88 @@
+package cas
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// fixedRand 产生和 golden 数据一致的随机序列: 第 i 个字符是 randomChars[(i*7+3)%48]
+func fixedRand() *bytes.Reader {
+	seq := make([]byte, 80)
+	for i := range seq {
+		seq[i] = byte((i*7 + 3) % len(randomChars))
+	}
+	return bytes.NewReader(seq)
+}
+
+// golden 数据由 encrypt.js 的 encryptAES 生成, Math.random 替换为
+// function() { return ((i++ * 7 + 3) % 48 + 0.5) / 48 }
+func TestAESEncryptorGolden(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		want     string
+	}{
+		{
+			"hunter2",
+			"rjBFAaHsNkKAhpoi",
+			"e+i5wmW87R6nopsLG0i5LZUuiRtJBf9aC+In+1AfZpqFUCFh4/Q7o8bFEa6JS5D3lgHDLV438iNYrs87ymns4SZ/uc3HaPJB4TNBi0UL2D4=",
+		},
+		{
+			"密码 with spaces",
+			"  k7Ty1QbHeWx9Zp2M\n",
+			"+OAEtKL/yT1mNEECgKCv1ikkTEvqRj/r5qbkZFfBIC74+GYFMEeju+ZWTJacKnyobh8TeT+ycJkMLi+DBk+0PrsANkTNzVj5q94zlm0Dp55thuQbKrJk6EsUckjlp1DT",
+		},
+		{
+			"0123456789abcdef0123456789abcdef",
+			"ZZZZZZZZZZZZZZZZ",
+			"cOrcI/A9cMjH/1QMji3Yz2F0k47hUB1O+CnNCPL4UE92uLf+ZSLVQm+wZ6wZ20YMxTcNYsfsjlW7teSIQjHnPWIf/ZUMAm6WOGoIZiRIWJ1Uu7IcT2K1gQqqcVw4RV5FvTNGelNATGRpQaOvGtRbDA==",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := AESEncryptor{Rand: fixedRand()}.Encrypt(tt.password, tt.salt)
+		if err != nil {
+			t.Fatalf("Encrypt(%q, %q): %v", tt.password, tt.salt, err)
+		}
+		if got != tt.want {
+			t.Errorf("Encrypt(%q, %q) = %q, want %q", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestAESEncryptorEmptySalt(t *testing.T) {
+	got, err := AESEncryptor{}.Encrypt("hunter2", "")
+	if err != nil || got != "hunter2" {
+		t.Errorf("Encrypt with empty salt = %q, %v, want the password unchanged", got, err)
+	}
+}
+
+func TestAESEncryptorRoundTrip(t *testing.T) {
+	const salt = "rjBFAaHsNkKAhpoi"
+	encrypted, err := AESEncryptor{}.Encrypt("hunter2", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// iv 是随机的, 但只影响第一个块, 解密后前缀之后的部分应该是原密码
+	block, _ := aes.NewCipher([]byte(salt))
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(plaintext, ciphertext)
+	plaintext = plaintext[:len(plaintext)-int(plaintext[len(plaintext)-1])]
+	if len(plaintext) != 64+len("hunter2") || !strings.HasSuffix(string(plaintext), "hunter2") {
+		t.Errorf("decrypted %q, want 64 random chars followed by the password", plaintext)
+	}
+	for _, c := range plaintext[aes.BlockSize:64] {
+		if !strings.ContainsRune(randomChars, rune(c)) {
+			t.Errorf("prefix contains %q, not in randomChars", c)
+		}
+	}
+}
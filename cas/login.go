@@ -0,0 +1,180 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+
+	"RubCourse/ehall"
+)
+
+const (
+	DefaultLoginURL = "https://authserver.szu.edu.cn/authserver/login"
+	// 登录后跳转到场馆预约
+	DefaultService = "https://ehall.szu.edu.cn:443/qljfwapp/sys/lwSzuCgyy/index.do#/sportVenue"
+)
+
+var (
+	// ErrLoginForm 表示登录页没有 form#pwdFromId 或缺少必要的字段
+	ErrLoginForm = errors.New("cas: login form incomplete")
+	// ErrLoginRejected 表示 authserver 没有接受登录, 通常是学号或密码错误
+	ErrLoginRejected = errors.New("cas: login rejected")
+)
+
+type Client struct {
+	LoginURL string
+	Service  string
+	// ehall 场馆预约的地址, 登录后访问一次拿到 _WEU
+	EhallURL   string
+	HTTPClient *http.Client
+	Encryptor  PasswordEncryptor
+}
+
+func NewClient() *Client {
+	return &Client{
+		LoginURL:   DefaultLoginURL,
+		Service:    DefaultService,
+		EhallURL:   ehall.DefaultBaseURL,
+		HTTPClient: http.DefaultClient,
+		Encryptor:  AESEncryptor{},
+	}
+}
+
+// loginForm 是登录页 form#pwdFromId 中需要提交的字段
+type loginForm struct {
+	lt        string
+	dllt      string
+	execution string
+	eventId   string
+	salt      string
+}
+
+// Login 登录 authserver 并跟随跳转到 ehall, 返回保存了 MOD_AUTH_CAS 和 _WEU 的会话
+func (c *Client) Login(ctx context.Context, username, password string) (*ehall.Session, error) {
+	session := ehall.NewSession()
+	httpClient := http.Client{}
+	if c.HTTPClient != nil {
+		httpClient = *c.HTTPClient
+	}
+	httpClient.Jar = session.Jar
+
+	loginURL := c.LoginURL + "?service=" + url.QueryEscape(c.Service)
+
+	// 打开登录页, 拿到表单字段
+	body, _, err := c.do(ctx, &httpClient, "GET", loginURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	form, err := parseLoginForm(body)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := c.Encryptor.Encrypt(password, form.salt)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt password: %w", err)
+	}
+
+	// 提交登录, authserver 会带着 ticket 跳转回 ehall, 跳转过程中的 cookie 都保存在 jar 里
+	values := url.Values{}
+	values.Set("username", username)
+	values.Set("password", encrypted)
+	values.Set("lt", form.lt)
+	values.Set("dllt", form.dllt)
+	values.Set("execution", form.execution)
+	values.Set("_eventId", form.eventId)
+	body, resp, err := c.do(ctx, &httpClient, "POST", loginURL, values)
+	if err != nil {
+		return nil, err
+	}
+	if session.Cookie(c.EhallURL, "MOD_AUTH_CAS") == "" {
+		return nil, fmt.Errorf("%w: %s", ErrLoginRejected, loginError(resp, body))
+	}
+
+	// 再访问一次 ehall 拿到最终的 _WEU
+	if _, _, err := c.do(ctx, &httpClient, "GET", c.EhallURL+"/index.do", nil); err != nil {
+		return nil, err
+	}
+	if session.Cookie(c.EhallURL, "_WEU") == "" {
+		return nil, fmt.Errorf("%w: ehall did not set _WEU", ErrLoginRejected)
+	}
+	return session, nil
+}
+
+func (c *Client) do(ctx context.Context, httpClient *http.Client, method, rawURL string, form url.Values) ([]byte, *http.Response, error) {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	byts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp, fmt.Errorf("read %s: %w", rawURL, err)
+	}
+	return byts, resp, nil
+}
+
+func parseLoginForm(body []byte) (loginForm, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return loginForm{}, fmt.Errorf("%w: %v", ErrLoginForm, err)
+	}
+	selection := doc.Find("form#pwdFromId")
+	if selection.Length() == 0 {
+		return loginForm{}, fmt.Errorf("%w: no form#pwdFromId", ErrLoginForm)
+	}
+
+	var form loginForm
+	var missing []string
+	required := func(selector, name string) string {
+		value, ok := selection.Find(selector).Attr("value")
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	}
+	form.lt = required("input[name=lt]", "lt")
+	form.execution = required("input[name=execution]", "execution")
+	form.salt = required("input#pwdEncryptSalt", "pwdEncryptSalt")
+	form.dllt, _ = selection.Find("input[name=dllt]").Attr("value")
+	form.eventId, _ = selection.Find("input[name=_eventId]").Attr("value")
+	if len(missing) > 0 {
+		return loginForm{}, fmt.Errorf("%w: missing %s", ErrLoginForm, strings.Join(missing, ", "))
+	}
+	return form, nil
+}
+
+// loginError 从登录失败的页面中找出错误提示
+func loginError(resp *http.Response, body []byte) string {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err == nil {
+		for _, selector := range []string{"#showErrorTip", "span#msg", ".auth_error"} {
+			if text := strings.TrimSpace(doc.Find(selector).First().Text()); text != "" {
+				return text
+			}
+		}
+	}
+	return "no MOD_AUTH_CAS after login, stopped at " + resp.Request.URL.String()
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"RubCourse/ehall"
+)
+
+// 场地列表的来源
+const (
+	catalogFromServer = "getCdxx.do"
+	catalogFromFile   = "badmiton.json"
+)
+
+// catalogEntry 是一个场馆中某个项目的场地列表
+type catalogEntry struct {
+	Venue     string
+	Sport     string
+	Source    string
+	FetchedAt time.Time
+	Courts    []Badminton
+}
+
+func (e *catalogEntry) key() string {
+	return catalogKey(ehall.Place{Venue: e.Venue, Sport: e.Sport})
+}
+
+// 从服务器刷新场地列表失败后, 多久之内不再刷新
+const catalogRetryAfter = 10 * time.Minute
+
+// catalogCache 缓存从服务器获取的场地列表和见过的场馆、项目、校区, 保存在 config.CatalogFile 中
+type catalogCache struct {
+	mu      sync.Mutex
+	loaded  bool
+	entries map[string]*catalogEntry
+	places  []knownPlace
+	// 最近一次刷新失败的时间, 不保存到文件
+	failedAt map[string]time.Time
+}
+
+// catalogFile 是 config.CatalogFile 的内容
+type catalogFile struct {
+	Courts []*catalogEntry
+	Places []knownPlace
+}
+
+var catalog = &catalogCache{entries: make(map[string]*catalogEntry)}
+
+// catalogKey 场地列表按场馆和项目区分
+func catalogKey(place ehall.Place) string {
+	place = place.WithDefaults()
+	return place.Venue + "/" + place.Sport
+}
+
+// Cached 返回缓存的场地列表, 没有缓存时使用 badmiton.json, 不访问网络
+func (c *catalogCache) Cached(place ehall.Place) catalogEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	if entry, ok := c.entries[catalogKey(place)]; ok {
+		return *entry
+	}
+	return fileCatalog(place)
+}
+
+// Places 返回见过的场馆、项目和校区
+func (c *catalogCache) Places() []knownPlace {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	return append([]knownPlace(nil), c.places...)
+}
+
+// RecordPlaces 记录场地行中的场馆、项目和校区, 有新的时保存
+func (c *catalogCache) RecordPlaces(rows []ehall.OpenRoomData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	changed := false
+	for _, row := range rows {
+		p := placeOf(row)
+		if p.Venue == "" || p.Sport == "" || p.Campus == "" {
+			continue
+		}
+		found := false
+		for _, known := range c.places {
+			found = found || known.Place == p.Place
+		}
+		if !found {
+			c.places = append(c.places, p)
+			changed = true
+		}
+	}
+	if changed {
+		sort.Slice(c.places, func(i, j int) bool { return c.places[i].String() < c.places[j].String() })
+		if err := c.save(); err != nil {
+			log.Printf("save court catalog failed: %v", err)
+		}
+	}
+}
+
+// Entries 返回所有缓存的场地列表, 默认场馆和项目没有缓存时加上 badmiton.json
+func (c *catalogCache) Entries() []catalogEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	var entries []catalogEntry
+	for _, entry := range c.entries {
+		entries = append(entries, *entry)
+	}
+	if _, ok := c.entries[catalogKey(ehall.Place{})]; !ok {
+		entries = append(entries, fileCatalog(ehall.Place{}))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key() < entries[j].key()
+	})
+	return entries
+}
+
+// Courts 返回抢票使用的场地列表. 缓存超过 config.CatalogTTL 时先从服务器刷新,
+// 刷新失败时继续使用旧的缓存或 badmiton.json, catalogRetryAfter 之内不再刷新,
+// 这样只有放票前准备场地列表时会请求失败的接口
+func (c *catalogCache) Courts(ctx context.Context, user *UserInfo, place ehall.Place) []Badminton {
+	cached := c.Cached(place)
+	if cached.Source == catalogFromServer && time.Since(cached.FetchedAt) < config.catalogTTL() {
+		return cached.Courts
+	}
+	if c.recentlyFailed(place) {
+		return cached.Courts
+	}
+	entry, err := c.Refresh(ctx, user, place)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("refresh court catalog failed, using %s: %v", cached.Source, err)
+			c.mu.Lock()
+			if c.failedAt == nil {
+				c.failedAt = make(map[string]time.Time)
+			}
+			c.failedAt[catalogKey(place)] = time.Now()
+			c.mu.Unlock()
+		}
+		return cached.Courts
+	}
+	return entry.Courts
+}
+
+// recentlyFailed 表示 catalogRetryAfter 之内从服务器刷新失败过
+func (c *catalogCache) recentlyFailed(place ehall.Place) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	failed, ok := c.failedAt[catalogKey(place)]
+	return ok && time.Since(failed) < catalogRetryAfter
+}
+
+// Refresh 用 user 的会话从服务器获取场地列表, 保存到缓存
+func (c *catalogCache) Refresh(ctx context.Context, user *UserInfo, place ehall.Place) (catalogEntry, error) {
+	place = place.WithDefaults()
+	today := time.Now().Format("2006-01-02")
+	courts, err := ehallClient(user).GetCourts(ctx, ehall.CourtQuery{
+		Place: place,
+		// 查询全天的场地
+		Slot: ehall.Slot{Date: today, Start: "08:00", End: "22:00"},
+	})
+	if err != nil {
+		return catalogEntry{}, ehallError(ctx, err)
+	}
+	if len(courts) == 0 {
+		return catalogEntry{}, fmt.Errorf("%w: getCdxx.do 没有返回场地", errRejected)
+	}
+
+	entry := &catalogEntry{
+		Venue:     place.Venue,
+		Sport:     place.Sport,
+		Source:    catalogFromServer,
+		FetchedAt: time.Now(),
+	}
+	for _, v := range courts {
+		entry.Courts = append(entry.Courts, Badminton{Id: v.Id, Name: v.Name})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	c.entries[catalogKey(place)] = entry
+	delete(c.failedAt, catalogKey(place))
+	if err := c.save(); err != nil {
+		log.Printf("save court catalog failed: %v", err)
+	}
+	return *entry, nil
+}
+
+// load 第一次使用时读取缓存文件, 调用时需要持有 c.mu
+func (c *catalogCache) load() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+	data, err := ioutil.ReadFile(config.CatalogFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf("read court catalog failed: %v", err)
+		return
+	}
+	var file catalogFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Printf("decode %s failed: %v", config.CatalogFile, err)
+		return
+	}
+	for _, entry := range file.Courts {
+		c.entries[entry.key()] = entry
+	}
+	c.places = file.Places
+}
+
+// save 把所有场地列表写入缓存文件, 调用时需要持有 c.mu
+func (c *catalogCache) save() error {
+	file := catalogFile{Places: c.places}
+	for _, entry := range c.entries {
+		file.Courts = append(file.Courts, entry)
+	}
+	sort.Slice(file.Courts, func(i, j int) bool {
+		return file.Courts[i].key() < file.Courts[j].key()
+	})
+	data, err := json.MarshalIndent(file, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(config.CatalogFile, data, 0644)
+}
+
+// fileCatalog 读取 badmiton.json, 它只有默认场馆的羽毛球场地
+func fileCatalog(place ehall.Place) catalogEntry {
+	place = place.WithDefaults()
+	entry := catalogEntry{Venue: place.Venue, Sport: place.Sport, Source: catalogFromFile}
+	if catalogKey(place) != catalogKey(ehall.Place{}) {
+		return entry
+	}
+	if info, err := os.Stat("./badmiton.json"); err == nil {
+		entry.FetchedAt = info.ModTime()
+	}
+	entry.Courts = readBadmintonFile()
+	return entry
+}
+
+// courtDiff 是两个场地列表的区别, 场地按 ID 对应
+type courtDiff struct {
+	Added   []Badminton
+	Removed []Badminton
+	Renamed []courtRename
+}
+
+type courtRename struct {
+	Id      string
+	OldName string
+	NewName string
+}
+
+func (d courtDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Renamed) == 0
+}
+
+func diffCourts(old, new []Badminton) courtDiff {
+	var diff courtDiff
+	oldById := make(map[string]Badminton)
+	for _, v := range old {
+		oldById[v.Id] = v
+	}
+	newById := make(map[string]bool)
+	for _, v := range new {
+		newById[v.Id] = true
+		before, ok := oldById[v.Id]
+		if !ok {
+			diff.Added = append(diff.Added, v)
+		} else if before.Name != v.Name {
+			diff.Renamed = append(diff.Renamed, courtRename{Id: v.Id, OldName: before.Name, NewName: v.Name})
+		}
+	}
+	for _, v := range old {
+		if !newById[v.Id] {
+			diff.Removed = append(diff.Removed, v)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"RubCourse/ehall"
+	"RubCourse/szutest"
+)
+
+func TestDiffCourts(t *testing.T) {
+	old := []Badminton{{Id: "1", Name: "羽毛球场A1"}, {Id: "2", Name: "羽毛球场A2"}, {Id: "3", Name: "羽毛球场A3"}}
+	new := []Badminton{{Id: "1", Name: "羽毛球场A1"}, {Id: "2", Name: "羽毛球场B2"}, {Id: "4", Name: "羽毛球场A4"}}
+	got := diffCourts(old, new)
+	want := courtDiff{
+		Added:   []Badminton{{Id: "4", Name: "羽毛球场A4"}},
+		Removed: []Badminton{{Id: "3", Name: "羽毛球场A3"}},
+		Renamed: []courtRename{{Id: "2", OldName: "羽毛球场A2", NewName: "羽毛球场B2"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffCourts = %+v, want %+v", got, want)
+	}
+	if !diffCourts(old, old).Empty() {
+		t.Error("diff of identical lists is not empty")
+	}
+}
+
+func TestCatalogRefreshAndCache(t *testing.T) {
+	srv := newFakeSZU(t)
+	user := testUser("20:00-21:00")
+	ctx := context.Background()
+	if err := getTheToken(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	courts := catalog.Courts(ctx, user, ehall.Place{})
+	if len(courts) != 2 || courts[0].Id != courtD6 {
+		t.Fatalf("courts = %+v, want the fake server's courts", courts)
+	}
+
+	// 缓存没过期时不再请求服务器
+	srv.RenameCourt(courtD6, "羽毛球场D6新")
+	catalog.Courts(ctx, user, ehall.Place{})
+	if n := srv.Calls("/getCdxx.do"); n != 1 {
+		t.Errorf("getCdxx.do called %d times, want 1", n)
+	}
+
+	// 重新读取缓存文件
+	catalog = &catalogCache{entries: make(map[string]*catalogEntry)}
+	if entry := catalog.Cached(ehall.Place{}); entry.Source != catalogFromServer || len(entry.Courts) != 2 {
+		t.Errorf("cached entry = %+v, want entry loaded from %s", entry, config.CatalogFile)
+	}
+
+	old := catalog.Cached(ehall.Place{})
+	entry, err := catalog.Refresh(ctx, user, ehall.Place{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := diffCourts(old.Courts, entry.Courts)
+	if len(diff.Renamed) != 1 || diff.Renamed[0].NewName != "羽毛球场D6新" {
+		t.Errorf("diff after rename = %+v", diff)
+	}
+}
+
+func TestCatalogFallsBackToFile(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.Inject("/getCdxx.do", 1, szutest.Fault{Status: 500})
+	user := testUser("20:00-21:00")
+	ctx := context.Background()
+	if err := getTheToken(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	courts := catalog.Courts(ctx, user, ehall.Place{})
+	if len(courts) == 0 || !reflect.DeepEqual(courts, readBadmintonFile()) {
+		t.Errorf("courts = %d entries, want badmiton.json", len(courts))
+	}
+	if other := catalog.Cached(ehall.Place{Venue: "002", Sport: "005"}); len(other.Courts) != 0 {
+		t.Errorf("badmiton.json used for another venue: %+v", other)
+	}
+}
+
+func TestCatalogRemembersFailedRefresh(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.Inject("/getCdxx.do", 100, szutest.Fault{Status: 500})
+	user := testUser("20:00-21:00")
+	ctx := context.Background()
+	if err := getTheToken(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	// 每次提交预约前都会取场地列表, 刷新失败后不能每次都请求服务器
+	for i := 0; i < 12; i++ {
+		if courts := catalog.Courts(ctx, user, ehall.Place{}); len(courts) == 0 {
+			t.Fatal("no courts after failed refresh")
+		}
+	}
+	if n := srv.Calls("/getCdxx.do"); n != 1 {
+		t.Errorf("getCdxx.do called %d times, want 1", n)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// 命令行退出码
+const (
+	exitOK        = 0
+	exitFailed    = 1
+	exitUsage     = 2
+	exitCancelled = 130
+)
+
+type cliOptions struct {
+	UserId string
+	// -user add/edit 时的姓名和手机号
+	UserName    string
+	PhoneNumber string
+	SportDate   string
+	// 逗号分隔的时间段和完成条件
+	Slots   string
+	Policy  string
+	ExecNow bool
+	// 已废弃的 -first、-second、-f 和 -s, 由 legacySlots 转换成 Slots
+	FirstTime  string
+	SecondTime string
+	FirstOnly  bool
+	SecondOnly bool
+	// 演练, 不提交预约
+	DryRun bool
+	// 场馆、项目和校区, 可以是代码或名字, 为空时使用默认值
+	Venue  string
+	Sport  string
+	Campus string
+	// 任务的场地偏好, 为空时使用用户的偏好
+	CourtsRanked  string
+	CourtsInclude string
+	CourtsExclude string
+	// 为空时使用配置文件
+	ReleaseTime   string
+	LoginLead     string
+	RetryInterval string
+}
+
+// legacySlots 把已废弃的 -first、-second、-f 和 -s 转换成 -slots 的值, set 是命令行中出现的参数.
+// 没有使用这些参数时返回 opts.Slots
+func legacySlots(opts cliOptions, set map[string]bool) (string, bool, error) {
+	if !set["first"] && !set["second"] && !set["f"] && !set["s"] {
+		return opts.Slots, false, nil
+	}
+	if set["slots"] {
+		return "", true, errors.New("-first、-second、-f 和 -s 不能和 -slots 一起使用")
+	}
+	// -f -s 同时使用等于两个都抢
+	switch {
+	case opts.FirstOnly && !opts.SecondOnly:
+		return opts.FirstTime, true, nil
+	case opts.SecondOnly && !opts.FirstOnly:
+		return opts.SecondTime, true, nil
+	}
+	return opts.FirstTime + "," + opts.SecondTime, true, nil
+}
+
+// runCLI 在终端为保存的用户抢票, 返回进程退出码
+func runCLI(opts cliOptions) int {
+	if opts.SportDate == "" {
+		fmt.Fprintln(os.Stderr, "需要用 -date 指定预约日期, 例如 -date 2023-09-17")
+		return exitUsage
+	}
+	if _, err := time.Parse("2006-01-02", opts.SportDate); err != nil {
+		fmt.Fprintf(os.Stderr, "预约日期格式错误: %v\n", err)
+		return exitUsage
+	}
+	slots, err := parseSlotChoices(opts.Slots)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	policy, err := parseCompletionPolicy(opts.Policy, len(slots))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	schedule, err := parseSchedule(opts.ReleaseTime, opts.LoginLead, opts.RetryInterval)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	courts, err := parseCourtPreference(opts.CourtsRanked, opts.CourtsInclude, opts.CourtsExclude)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	place, err := resolvePlace(opts.Venue, opts.Sport, opts.Campus)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	stored, err := findUser(opts.UserId)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	user := UserInfo{
+		UserId:      stored.UserId,
+		UserName:    stored.UserName,
+		Password:    stored.Password,
+		PhoneNumber: stored.PhoneNumber,
+		SportDate:   opts.SportDate,
+		Slots:       slots,
+		Policy:      policy,
+		Schedule:    schedule,
+		DryRun:      opts.DryRun,
+		Courts:      stored.Courts,
+		TaskCourts:  courts,
+		Place:       place,
+	}
+	if opts.ExecNow {
+		user.IfExecNow = "1"
+	}
+
+	// Ctrl+C 取消任务
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	id, err := registerGoroutine(&user, cancel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	err = startRub(ctx, &user, id)
+	unregisterGoroutine(id, err)
+
+	if info, terr := store.Task(id); terr == nil {
+		log.Printf("%s %s %s", user.UserName, user.SportDate, taskMessage(info))
+	} else {
+		log.Printf("%s %s %v", user.UserName, user.SportDate, err)
+	}
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, context.Canceled):
+		return exitCancelled
+	default:
+		return exitFailed
+	}
+}
+
+// runCatalogCLI 列出或对比场地列表, 返回进程退出码
+func runCatalogCLI(cmd string, opts cliOptions) int {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	userId := opts.UserId
+	place, err := resolvePlace(opts.Venue, opts.Sport, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	switch cmd {
+	case "list":
+		if userId != "" {
+			if _, err := refreshCatalog(ctx, userId, place); err != nil {
+				fmt.Fprintln(os.Stderr, "刷新场地列表失败:", err)
+				return exitFailed
+			}
+		}
+		for _, entry := range catalog.Entries() {
+			fmt.Printf("场馆 %s 项目 %s, 来源 %s, 更新时间 %s\n", entry.Venue, entry.Sport, entry.Source, entry.FetchedAt.Format("2006-01-02 15:04:05"))
+			for _, v := range entry.Courts {
+				fmt.Printf("  %s\t%s\n", v.Name, v.Id)
+			}
+		}
+		if places := catalog.Places(); len(places) > 0 {
+			fmt.Println("见过的校区、场馆和项目 (XQDM/CGBM/XMDM):")
+			for _, p := range places {
+				fmt.Printf("  %s\t%s/%s/%s\n", p, p.Campus, p.Venue, p.Sport)
+			}
+		}
+		return exitOK
+	case "diff":
+		if userId == "" {
+			fmt.Fprintln(os.Stderr, "-catalog diff 需要用 -u 指定登录的学号")
+			return exitUsage
+		}
+		user, err := findUser(userId)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		if err := getTheToken(ctx, user); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailed
+		}
+		entry, err := catalog.Refresh(ctx, user, place)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "获取场地列表失败:", err)
+			return exitFailed
+		}
+		diff := diffCourts(fileCatalog(place).Courts, entry.Courts)
+		if diff.Empty() {
+			fmt.Println("badmiton.json 和服务器的场地一致")
+			return exitOK
+		}
+		for _, v := range diff.Added {
+			fmt.Printf("+ %s\t%s\n", v.Name, v.Id)
+		}
+		for _, v := range diff.Removed {
+			fmt.Printf("- %s\t%s\n", v.Name, v.Id)
+		}
+		for _, v := range diff.Renamed {
+			fmt.Printf("~ %s -> %s\t%s\n", v.OldName, v.NewName, v.Id)
+		}
+		return exitFailed
+	default:
+		fmt.Fprintf(os.Stderr, "未知的 -catalog 命令 %q, 可以是 list 或 diff\n", cmd)
+		return exitUsage
+	}
+}
+
+// runUserCLI 列出、新增、修改、删除保存的用户或者验证密码, 返回进程退出码.
+// 新增和修改时从 stdin 读取密码, 不出现在命令行参数中
+func runUserCLI(cmd string, opts cliOptions, stdin io.Reader) int {
+	if cmd == "list" {
+		users, err := listUsers()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailed
+		}
+		for _, v := range users {
+			fmt.Printf("%s\t%s\t%s\t%s\n", v.UserId, v.UserName, v.PhoneNumber, v.Courts)
+		}
+		return exitOK
+	}
+	if cmd == "import" {
+		err := store.ImportUsers()
+		if errors.Is(err, errNoUserFile) {
+			fmt.Fprintf(os.Stderr, "%v: %s, %s 和 %s 都不存在\n", err, config.CredentialFile, legacyUsersFile, legacyUsersBackup)
+			return exitUsage
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailed
+		}
+		fmt.Println("已导入")
+		return exitOK
+	}
+
+	if opts.UserId == "" {
+		fmt.Fprintf(os.Stderr, "-user %s 需要用 -u 指定学号\n", cmd)
+		return exitUsage
+	}
+	courtsSet := opts.CourtsRanked != "" || opts.CourtsInclude != "" || opts.CourtsExclude != ""
+	courts, err := parseCourtPreference(opts.CourtsRanked, opts.CourtsInclude, opts.CourtsExclude)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	var done string
+	switch cmd {
+	case "add":
+		done = "已新增"
+		user := &UserInfo{UserId: opts.UserId, UserName: opts.UserName, PhoneNumber: opts.PhoneNumber, Courts: courts}
+		user.Password = readPassword(stdin, "密码: ")
+		err = addUser(user)
+	case "edit":
+		done = "已修改"
+		var user *UserInfo
+		if user, err = findUser(opts.UserId); err != nil {
+			break
+		}
+		if opts.UserName != "" {
+			user.UserName = opts.UserName
+		}
+		if opts.PhoneNumber != "" {
+			user.PhoneNumber = opts.PhoneNumber
+		}
+		if courtsSet {
+			user.Courts = courts
+		}
+		user.Password = readPassword(stdin, "新密码 (留空不修改): ")
+		err = updateUser(user)
+	case "delete":
+		done = "已删除"
+		err = deleteUser(opts.UserId)
+	case "verify":
+		done = "登录成功"
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+		err = verifyCredentials(ctx, opts.UserId)
+	default:
+		fmt.Fprintf(os.Stderr, "未知的 -user 命令 %q, 可以是 list, add, edit, delete, verify 或 import\n", cmd)
+		return exitUsage
+	}
+
+	switch {
+	case err == nil:
+		fmt.Println(opts.UserId, done)
+		return exitOK
+	case errors.Is(err, errInvalidUser), errors.Is(err, errUserExists), errors.Is(err, errUserNotFound):
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+}
+
+// readPassword 从 stdin 读取一行密码
+func readPassword(stdin io.Reader, prompt string) string {
+	fmt.Fprint(os.Stderr, prompt)
+	line, _ := bufio.NewReader(stdin).ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"RubCourse/ehall"
+)
+
+// Config 是 config.json 的内容, 每个任务没有填写的参数使用这里的默认值
+type Config struct {
+	// 每天放票时间, 格式 15:04:05
+	ReleaseTime string `json:"releaseTime"`
+	// 提前多久登录, 例如 4s
+	LoginLead string `json:"loginLead"`
+	// 抢票失败后的重试间隔, 例如 3s
+	RetryInterval string `json:"retryInterval"`
+	// 按 ehall 服务器时间抢票
+	ClockSync bool `json:"clockSync"`
+	// 校准时间时请求的次数
+	ClockSamples int `json:"clockSamples"`
+	// 加密本地数据的密钥文件, 设置了环境变量 RUB_MASTER_KEY 时不使用
+	KeyFile string `json:"keyFile"`
+	// 保存用户、任务和预约记录的数据库文件
+	DBFile string `json:"dbFile"`
+	// 旧版本加密保存用户的文件, 升级数据库时导入
+	CredentialFile string `json:"credentialFile"`
+	// 保存登录会话的目录
+	SessionDir string `json:"sessionDir"`
+	// 登录会话估计的有效时间, 例如 2h
+	SessionTTL string `json:"sessionTTL"`
+	// 场地状态快照的刷新间隔, 例如 10s. 快照中没有空闲场地时总是重新查询
+	AvailabilityRefresh string `json:"availabilityRefresh"`
+	// 每个场次最多同时尝试前几个空闲的场地
+	CourtAttempts int `json:"courtAttempts"`
+	// 同时提交预约的请求数
+	InsertWorkers int `json:"insertWorkers"`
+	// 场地列表的缓存文件
+	CatalogFile string `json:"catalogFile"`
+	// 场地列表缓存的有效时间, 例如 24h, 超过后抢票时从服务器刷新
+	CatalogTTL string `json:"catalogTTL"`
+	// 获取场地列表的地址, 也可以是相对于 ehall 预约应用的路径
+	CourtsURL string `json:"courtsURL"`
+	// 把和 ehall、authserver 之间的请求记录到这个 JSONL 文件, 为空时不记录
+	RecordFile string `json:"recordFile"`
+}
+
+var defaultConfig = Config{
+	ReleaseTime:         "12:30:00",
+	LoginLead:           "4s",
+	RetryInterval:       "3s",
+	ClockSync:           true,
+	ClockSamples:        8,
+	KeyFile:             "master.key",
+	DBFile:              "rub.db",
+	CredentialFile:      "credentials.json",
+	SessionDir:          "sessions",
+	SessionTTL:          "2h",
+	CourtAttempts:       3,
+	InsertWorkers:       3,
+	AvailabilityRefresh: "10s",
+	CatalogFile:         "catalog.json",
+	CatalogTTL:          "24h",
+	CourtsURL:           ehall.DefaultCourtsURL,
+}
+
+var config = defaultConfig
+
+// loadConfig 读取配置文件, 文件不存在时使用默认配置
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("decode %s: %w", path, err)
+	}
+	if _, err := cfg.Schedule(); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	if ttl, err := time.ParseDuration(cfg.SessionTTL); err != nil || ttl <= 0 {
+		return cfg, fmt.Errorf("%s: 会话有效时间格式错误: %q", path, cfg.SessionTTL)
+	}
+	if refresh, err := time.ParseDuration(cfg.AvailabilityRefresh); err != nil || refresh < 0 {
+		return cfg, fmt.Errorf("%s: 场地状态刷新间隔格式错误: %q", path, cfg.AvailabilityRefresh)
+	}
+	if ttl, err := time.ParseDuration(cfg.CatalogTTL); err != nil || ttl < 0 {
+		return cfg, fmt.Errorf("%s: 场地列表有效时间格式错误: %q", path, cfg.CatalogTTL)
+	}
+	if cfg.CourtAttempts < 1 || cfg.InsertWorkers < 1 {
+		return cfg, fmt.Errorf("%s: courtAttempts 和 insertWorkers 至少为 1", path)
+	}
+	return cfg, nil
+}
+
+func (c Config) sessionTTL() time.Duration {
+	ttl, _ := time.ParseDuration(c.SessionTTL)
+	return ttl
+}
+
+// availabilityRefresh 是场地状态快照的刷新间隔
+func (c Config) availabilityRefresh() time.Duration {
+	refresh, _ := time.ParseDuration(c.AvailabilityRefresh)
+	return refresh
+}
+
+// catalogTTL 是场地列表缓存的有效时间
+func (c Config) catalogTTL() time.Duration {
+	ttl, _ := time.ParseDuration(c.CatalogTTL)
+	return ttl
+}
+
+// Schedule 是默认的任务时间安排
+func (c Config) Schedule() (Schedule, error) {
+	return parseSchedule(c.ReleaseTime, c.LoginLead, c.RetryInterval)
+}
+
+// Schedule 是一个任务的时间安排
+type Schedule struct {
+	// 每天放票时间, 格式 15:04:05
+	ReleaseTime string
+	// 提前多久登录
+	LoginLead time.Duration
+	// 抢票失败后的重试间隔
+	RetryInterval time.Duration
+}
+
+// parseSchedule 解析任务的时间安排, 空字符串使用 config 中的默认值
+func parseSchedule(releaseTime, loginLead, retryInterval string) (Schedule, error) {
+	if releaseTime == "" {
+		releaseTime = config.ReleaseTime
+	}
+	if loginLead == "" {
+		loginLead = config.LoginLead
+	}
+	if retryInterval == "" {
+		retryInterval = config.RetryInterval
+	}
+
+	// 网页上的 time 输入框可能不带秒
+	if len(releaseTime) == len("15:04") {
+		releaseTime += ":00"
+	}
+	if _, err := time.Parse("15:04:05", releaseTime); err != nil {
+		return Schedule{}, fmt.Errorf("放票时间格式错误: %v", err)
+	}
+	lead, err := time.ParseDuration(loginLead)
+	if err != nil || lead < 0 {
+		return Schedule{}, fmt.Errorf("提前登录时间格式错误: %q", loginLead)
+	}
+	retry, err := time.ParseDuration(retryInterval)
+	if err != nil || retry <= 0 {
+		return Schedule{}, fmt.Errorf("重试间隔格式错误: %q", retryInterval)
+	}
+	return Schedule{ReleaseTime: releaseTime, LoginLead: lead, RetryInterval: retry}, nil
+}
+
+// Next 计算 now 之后的下一次登录时间和放票时间
+func (s Schedule) Next(now time.Time) (login time.Time, release time.Time) {
+	t, _ := time.Parse("15:04:05", s.ReleaseTime)
+	release = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+	if now.After(release.Add(-s.LoginLead)) {
+		// 如果当前已经是预设的时间之后，计算下一个时刻(明天这个点)
+		release = release.Add(24 * time.Hour)
+	}
+	return release.Add(-s.LoginLead), release
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CourtPreference 是场地偏好, 每一项可以是场地名、场地 ID 或者场地名的通配符, 例如 羽毛球场B*
+type CourtPreference struct {
+	// 按顺序优先尝试的场地, 没有列出的场地排在后面
+	Ranked []string `json:",omitempty"`
+	// 不为空时只尝试匹配的场地
+	Include []string `json:",omitempty"`
+	// 不尝试匹配的场地
+	Exclude []string `json:",omitempty"`
+}
+
+// parseCourtPreference 解析逗号或空格分隔的场地列表
+func parseCourtPreference(ranked, include, exclude string) (CourtPreference, error) {
+	pref := CourtPreference{
+		Ranked:  splitCourts(ranked),
+		Include: splitCourts(include),
+		Exclude: splitCourts(exclude),
+	}
+	for _, list := range [][]string{pref.Ranked, pref.Include, pref.Exclude} {
+		for _, pattern := range list {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return pref, fmt.Errorf("场地通配符格式错误: %q", pattern)
+			}
+		}
+	}
+	return pref, nil
+}
+
+func splitCourts(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '，' || r == ' ' || r == '\n' || r == '\t'
+	})
+}
+
+// Or 返回任务的偏好, 任务没有设置的项使用用户的偏好
+func (p CourtPreference) Or(user CourtPreference) CourtPreference {
+	if len(p.Ranked) == 0 {
+		p.Ranked = user.Ranked
+	}
+	if len(p.Include) == 0 {
+		p.Include = user.Include
+	}
+	if len(p.Exclude) == 0 {
+		p.Exclude = user.Exclude
+	}
+	return p
+}
+
+// Order 按偏好过滤并排序场地, 同样优先的场地保持原来的顺序
+func (p CourtPreference) Order(courts []Badminton) []Badminton {
+	var candidates []Badminton
+	for _, court := range courts {
+		if len(p.Include) > 0 && !matchCourt(p.Include, court) {
+			continue
+		}
+		if matchCourt(p.Exclude, court) {
+			continue
+		}
+		candidates = append(candidates, court)
+	}
+
+	ordered := make([]Badminton, 0, len(candidates))
+	added := make(map[string]bool)
+	for _, pattern := range p.Ranked {
+		for _, court := range candidates {
+			if !added[court.Id] && matchCourt([]string{pattern}, court) {
+				ordered = append(ordered, court)
+				added[court.Id] = true
+			}
+		}
+	}
+	for _, court := range candidates {
+		if !added[court.Id] {
+			ordered = append(ordered, court)
+		}
+	}
+	return ordered
+}
+
+// String 用于在页面和日志中显示偏好
+func (p CourtPreference) String() string {
+	var parts []string
+	if len(p.Ranked) > 0 {
+		parts = append(parts, "优先 "+strings.Join(p.Ranked, ","))
+	}
+	if len(p.Include) > 0 {
+		parts = append(parts, "只选 "+strings.Join(p.Include, ","))
+	}
+	if len(p.Exclude) > 0 {
+		parts = append(parts, "排除 "+strings.Join(p.Exclude, ","))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func matchCourt(patterns []string, court Badminton) bool {
+	for _, pattern := range patterns {
+		if pattern == court.Id {
+			return true
+		}
+		if ok, _ := path.Match(pattern, court.Name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCourtPreferenceOrder(t *testing.T) {
+	courts := []Badminton{
+		{Id: "d6", Name: "羽毛球场D6"},
+		{Id: "c6", Name: "羽毛球场C6"},
+		{Id: "b5", Name: "羽毛球场B5"},
+		{Id: "b1", Name: "羽毛球场B1"},
+		{Id: "a1", Name: "羽毛球场A1"},
+	}
+	tests := []struct {
+		name                     string
+		ranked, include, exclude string
+		want                     []string
+	}{
+		{"none", "", "", "", []string{"d6", "c6", "b5", "b1", "a1"}},
+		{"ranked", "羽毛球场B1, 羽毛球场C*", "", "", []string{"b1", "c6", "d6", "b5", "a1"}},
+		{"wildcard keeps order", "羽毛球场B*", "", "", []string{"b5", "b1", "d6", "c6", "a1"}},
+		{"include", "羽毛球场B1", "羽毛球场B*，a1", "", []string{"b1", "b5", "a1"}},
+		{"exclude", "", "", "羽毛球场D*,c6", []string{"b5", "b1", "a1"}},
+		{"exclude wins", "羽毛球场A1", "羽毛球场A*", "a1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pref, err := parseCourtPreference(tt.ranked, tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range pref.Order(courts) {
+				got = append(got, c.Id)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCourtPreferenceOr(t *testing.T) {
+	user := CourtPreference{Ranked: []string{"羽毛球场B*"}, Exclude: []string{"羽毛球场D6"}}
+	task := CourtPreference{Ranked: []string{"羽毛球场C6"}}
+	got := task.Or(user)
+	want := CourtPreference{Ranked: []string{"羽毛球场C6"}, Exclude: []string{"羽毛球场D6"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Or = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseCourtPreferenceBadPattern(t *testing.T) {
+	if _, err := parseCourtPreference("羽毛球场[B", "", ""); err == nil {
+		t.Error("expected error for bad pattern")
+	}
+}
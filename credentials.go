@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 旧版本明文保存用户的文件, 升级数据库时导入后删除
+var legacyUsersFile = "users"
+
+// users 曾经在 git 中, git pull 到不再包含它的版本时会被删除, 可以从 git 历史恢复到这里再导入, 见 README
+var legacyUsersBackup = "users.bak"
+
+var (
+	errUserExists   = errors.New("已经有这个用户")
+	errUserNotFound = errors.New("没有这个用户")
+	errInvalidUser  = errors.New("用户信息格式错误")
+	errNoUserFile   = errors.New("没有旧版本的用户文件")
+)
+
+var (
+	// 深大学号是 10 位数字, 例如 2300271032
+	userIdPattern = regexp.MustCompile(`^[0-9]{10}$`)
+	// 大陆手机号
+	phonePattern = regexp.MustCompile(`^1[3-9][0-9]{9}$`)
+)
+
+// validateUser 检查学号、姓名和手机号, 手机号可以为空 (不发送短信)
+func validateUser(user *UserInfo) error {
+	if !userIdPattern.MatchString(user.UserId) {
+		return fmt.Errorf("%w: 学号 %q 应为 10 位数字", errInvalidUser, user.UserId)
+	}
+	if user.UserName == "" {
+		return fmt.Errorf("%w: 姓名不能为空", errInvalidUser)
+	}
+	if user.PhoneNumber != "" && !phonePattern.MatchString(user.PhoneNumber) {
+		return fmt.Errorf("%w: 手机号 %q 应为 11 位数字", errInvalidUser, user.PhoneNumber)
+	}
+	return nil
+}
+
+// storedUser 是数据库中的一个用户, 密码用主密钥加密
+type storedUser struct {
+	UserId      string
+	UserName    string
+	PhoneNumber string
+	Password    []byte
+	Courts      CourtPreference
+}
+
+// userSummary 是页面上显示的用户信息, 不包含密码
+type userSummary struct {
+	UserId      string
+	UserName    string
+	PhoneNumber string
+	Courts      CourtPreference
+}
+
+// importUserFiles 把旧版本的用户文件导入数据库: 优先导入加密的 config.CredentialFile,
+// 没有时加密导入明文的 users 文件或者它的备份 users.bak. 已经有的用户不覆盖, 事务提交后删除导入的文件.
+// 都没有时返回 errNoUserFile
+func importUserFiles(tx *bolt.Tx) error {
+	var users []storedUser
+	source := config.CredentialFile
+	data, err := ioutil.ReadFile(source)
+	if errors.Is(err, os.ErrNotExist) {
+		for _, source = range []string{legacyUsersFile, legacyUsersBackup} {
+			if data, err = ioutil.ReadFile(source); !errors.Is(err, os.ErrNotExist) {
+				break
+			}
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			return errNoUserFile
+		}
+		if err != nil {
+			return err
+		}
+		var legacy []*UserInfo
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return fmt.Errorf("decode %s: %w", source, err)
+		}
+		for _, v := range legacy {
+			stored, err := sealUser(v)
+			if err != nil {
+				return err
+			}
+			users = append(users, stored)
+		}
+	} else if err != nil {
+		return err
+	} else if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("decode %s: %w", source, err)
+	}
+
+	b := tx.Bucket(bucketUsers)
+	imported := 0
+	for _, v := range users {
+		if b.Get([]byte(v.UserId)) != nil {
+			log.Printf("user %s already exists, not imported from %s", v.UserId, source)
+			continue
+		}
+		if err := putJSON(b, []byte(v.UserId), v); err != nil {
+			return err
+		}
+		imported++
+	}
+	tx.OnCommit(func() {
+		if err := os.Remove(source); err != nil {
+			log.Printf("remove %s failed: %v", source, err)
+		}
+		log.Printf("imported %d users from %s", imported, source)
+	})
+	return nil
+}
+
+func sealUser(user *UserInfo) (storedUser, error) {
+	password, err := encryptSecret([]byte(user.Password))
+	if err != nil {
+		return storedUser{}, fmt.Errorf("encrypt password of %s: %w", user.UserId, err)
+	}
+	return storedUser{
+		UserId:      user.UserId,
+		UserName:    user.UserName,
+		PhoneNumber: user.PhoneNumber,
+		Password:    password,
+		Courts:      user.Courts,
+	}, nil
+}
+
+func (s storedUser) open() (*UserInfo, error) {
+	password, err := decryptSecret(s.Password)
+	if err != nil {
+		return nil, fmt.Errorf("password of %s: %w", s.UserId, err)
+	}
+	return &UserInfo{
+		UserId:      s.UserId,
+		UserName:    s.UserName,
+		PhoneNumber: s.PhoneNumber,
+		Password:    string(password),
+		Courts:      s.Courts,
+	}, nil
+}
+
+// listUsers 返回所有用户, 不解密密码
+func listUsers() ([]userSummary, error) {
+	users, err := store.Users()
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]userSummary, 0, len(users))
+	for _, v := range users {
+		summaries = append(summaries, userSummary{UserId: v.UserId, UserName: v.UserName, PhoneNumber: v.PhoneNumber, Courts: v.Courts})
+	}
+	return summaries, nil
+}
+
+// findUser 返回解密后的用户
+func findUser(userId string) (*UserInfo, error) {
+	stored, err := store.User(userId)
+	if err != nil {
+		return nil, err
+	}
+	return stored.open()
+}
+
+// addUser 加密保存新用户, 学号已经存在时返回 errUserExists
+func addUser(user *UserInfo) error {
+	if err := validateUser(user); err != nil {
+		return err
+	}
+	if user.Password == "" {
+		return fmt.Errorf("%w: 密码不能为空", errInvalidUser)
+	}
+	stored, err := sealUser(user)
+	if err != nil {
+		return err
+	}
+	return store.InsertUser(stored)
+}
+
+// updateUser 修改保存的用户的姓名、手机号和场地偏好, 密码为空时不修改密码
+func updateUser(user *UserInfo) error {
+	if err := validateUser(user); err != nil {
+		return err
+	}
+	return store.UpdateUser(user.UserId, func(stored *storedUser) error {
+		if user.Password != "" {
+			password, err := encryptSecret([]byte(user.Password))
+			if err != nil {
+				return fmt.Errorf("encrypt password of %s: %w", user.UserId, err)
+			}
+			stored.Password = password
+		}
+		stored.UserName = user.UserName
+		stored.PhoneNumber = user.PhoneNumber
+		stored.Courts = user.Courts
+		return nil
+	})
+}
+
+// deleteUser 删除保存的用户和保存的登录会话
+func deleteUser(userId string) error {
+	if err := store.DeleteUser(userId); err != nil {
+		return err
+	}
+	if err := os.Remove(sessionPath(userId)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("remove session of %s failed: %v", userId, err)
+	}
+	return nil
+}
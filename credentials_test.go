@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProcessDoesNotRenderPasswords(t *testing.T) {
+	newFakeSZU(t)
+	if err := addUser(&UserInfo{UserId: testUserId, UserName: "测试", Password: testPassword}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	process(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `value="`+testUserId+`"`) {
+		t.Errorf("user dropdown does not reference %s by ID", testUserId)
+	}
+	if strings.Contains(body, testPassword) {
+		t.Error("page contains the password")
+	}
+}
+
+func TestProcessRunsStoredUserById(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00")
+	if err := addUser(&UserInfo{UserId: testUserId, UserName: "测试", Password: testPassword}); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{
+		"stored_user":   {testUserId},
+		"sportDate":     {testDate},
+		"slotStart":     {"20:00"},
+		"slotEnd":       {""},
+		"ifExecuteNow":  {"1"},
+		"retryInterval": {"10ms"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	process(rec, req)
+
+	if !strings.Contains(rec.Body.String(), "预约结果: 成功") {
+		t.Errorf("result page does not report success")
+	}
+	if bookings := srv.Bookings(); len(bookings) != 1 || bookings[0].UserId != testUserId {
+		t.Errorf("bookings = %+v, want one for %s", bookings, testUserId)
+	}
+}
+
+func TestUserCLI(t *testing.T) {
+	newFakeSZU(t)
+	opts := cliOptions{UserId: testUserId, UserName: "测试", PhoneNumber: "13800000000"}
+
+	if code := runUserCLI("add", opts, strings.NewReader("wrong\n")); code != exitOK {
+		t.Fatalf("add exit code = %d", code)
+	}
+	if code := runUserCLI("verify", opts, nil); code != exitFailed {
+		t.Errorf("verify with wrong password exit code = %d, want %d", code, exitFailed)
+	}
+
+	// 只改密码, 姓名和手机号不变
+	if code := runUserCLI("edit", cliOptions{UserId: testUserId}, strings.NewReader(testPassword+"\n")); code != exitOK {
+		t.Fatalf("edit exit code = %d", code)
+	}
+	user, err := findUser(testUserId)
+	if err != nil || user.Password != testPassword || user.PhoneNumber != "13800000000" || user.UserName != "测试" {
+		t.Fatalf("after edit user = %+v, %v", user, err)
+	}
+	if code := runUserCLI("verify", opts, nil); code != exitOK {
+		t.Errorf("verify exit code = %d, want %d", code, exitOK)
+	}
+
+	bad := opts
+	bad.PhoneNumber = "1380000"
+	if code := runUserCLI("edit", bad, strings.NewReader("\n")); code != exitUsage {
+		t.Errorf("edit with bad phone exit code = %d, want %d", code, exitUsage)
+	}
+	bad = opts
+	bad.UserId = "23002710"
+	if code := runUserCLI("add", bad, strings.NewReader("x\n")); code != exitUsage {
+		t.Errorf("add with bad student id exit code = %d, want %d", code, exitUsage)
+	}
+
+	if code := runUserCLI("delete", opts, nil); code != exitOK {
+		t.Fatalf("delete exit code = %d", code)
+	}
+	if _, err := findUser(testUserId); !errors.Is(err, errUserNotFound) {
+		t.Errorf("findUser after delete err = %v, want %v", err, errUserNotFound)
+	}
+	if code := runUserCLI("delete", opts, nil); code != exitUsage {
+		t.Errorf("delete missing user exit code = %d, want %d", code, exitUsage)
+	}
+}
+
+func TestAddPageManagesUsers(t *testing.T) {
+	newFakeSZU(t)
+	post := func(form url.Values) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/add", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		add(rec, req)
+		return rec.Body.String()
+	}
+
+	if body := post(url.Values{"action": {"add"}, "user_id": {testUserId}, "user_name": {"测试"}, "password": {testPassword}, "phone_number": {"123"}}); !strings.Contains(body, "手机号") {
+		t.Error("invalid phone number accepted")
+	}
+	post(url.Values{"action": {"add"}, "user_id": {testUserId}, "user_name": {"测试"}, "password": {testPassword}})
+	if body := post(url.Values{"action": {"verify"}, "user_id": {testUserId}}); !strings.Contains(body, testUserId+" 登录成功") {
+		t.Error("verify did not report success")
+	}
+	post(url.Values{"action": {"edit"}, "user_id": {testUserId}, "user_name": {"改名"}, "phone_number": {"13800000000"}})
+	if user, err := findUser(testUserId); err != nil || user.UserName != "改名" || user.Password != testPassword {
+		t.Errorf("after edit user = %+v, %v", user, err)
+	}
+	if body := post(url.Values{"action": {"delete"}, "user_id": {testUserId}}); strings.Contains(body, "改名") {
+		t.Error("deleted user still listed")
+	}
+}
@@ -0,0 +1,271 @@
+// Package ehall 封装了深大 ehall 场馆预约 (lwSzuCgyy) 的接口
+package ehall
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	gojsonq "github.com/thedevsaddam/gojsonq/v2"
+)
+
+const (
+	DefaultBaseURL = "https://ehall.szu.edu.cn/qljfwapp/sys/lwSzuCgyy"
+	// 获取场地列表的地址, 旧版本一直使用的是公共应用下的这个接口
+	DefaultCourtsURL = "https://ehall.szu.edu.cn/publicapp/sys/tycgyyxt/sportVenue/getCdxx.do"
+
+	// 羽毛球, 粤海校区
+	DefaultVenue  = "001"
+	DefaultSport  = "001"
+	DefaultCampus = "1"
+
+	// 可预约状态的文字
+	TextAvailable = "可预约"
+)
+
+type Client struct {
+	BaseURL string
+	// 获取场地列表的地址, 不以 http 开头时相对于 BaseURL
+	CourtsURL  string
+	Session    *Session
+	HTTPClient *http.Client
+}
+
+func NewClient(session *Session) *Client {
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		CourtsURL:  DefaultCourtsURL,
+		Session:    session,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// GetOrderNum 获取订单号
+func (c *Client) GetOrderNum(ctx context.Context) (string, error) {
+	byts, _, err := c.post(ctx, "/sportVenue/getOrderNum.do", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	dh := DH{}
+	if err := json.Unmarshal(byts, &dh); err != nil {
+		return "", fmt.Errorf("decode getOrderNum.do: %v: %w", err, ErrUnexpectedResponse)
+	}
+	return dh.DHID, nil
+}
+
+// CheckSession 检查会话是否还有效, 登录失效时 ehall 返回的不是 JSON
+func (c *Client) CheckSession(ctx context.Context) (bool, error) {
+	_, err := c.GetOrderNum(ctx)
+	if errors.Is(err, ErrAuthExpired) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetTimeList 获取某天某个校区和项目所有时间段的预约状态
+func (c *Client) GetTimeList(ctx context.Context, date string, place Place) ([]KYY, error) {
+	place = place.WithDefaults()
+	formValues := url.Values{}
+	formValues.Set("XQ", place.Campus)
+	formValues.Set("YYRQ", date)
+	formValues.Set("XMDM", place.Sport)
+	formValues.Set("YYLX", "1.0")
+
+	byts, _, err := c.post(ctx, "/sportVenue/getTimeList.do", formValues, func(req *http.Request) {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
+		req.Header.Set("Accept", "*/*")
+		req.Header.Add("Origin", req.URL.Scheme+"://"+req.URL.Host)
+		req.Header.Add("Referer", c.BaseURL+"/index.do")
+		// no need to modify
+		req.AddCookie(&http.Cookie{Name: "asessionid", Value: "f7d75b63-1d8d-4b30-91c1-3ea268e2a296"})
+		req.AddCookie(&http.Cookie{Name: "route", Value: "c74f3c8250d849c2cfd6230ee3f779bd"})
+		req.AddCookie(&http.Cookie{Name: "amp.locale", Value: "undefined"})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var kyyData []KYY
+	if err := json.Unmarshal(byts, &kyyData); err != nil {
+		return nil, fmt.Errorf("decode getTimeList.do: %v: %w", err, ErrUnexpectedResponse)
+	}
+	return kyyData, nil
+}
+
+// GetOpeningRoom 获取某个时间段某个校区和项目所有场地的预约状态, 可能包含多个场馆
+func (c *Client) GetOpeningRoom(ctx context.Context, slot Slot, place Place) ([]OpenRoomData, error) {
+	place = place.WithDefaults()
+	formValues := url.Values{}
+	formValues.Set("XMDM", place.Sport)
+	formValues.Set("YYRQ", slot.Date)
+	formValues.Set("YYLX", "1.0")
+	formValues.Set("KSSJ", slot.Start)
+	formValues.Set("JSSJ", slot.End)
+	formValues.Set("XQDM", place.Campus)
+
+	byts, _, err := c.post(ctx, "/modules/sportVenue/getOpeningRoom.do", formValues, nil)
+	if err != nil {
+		return nil, err
+	}
+	openRoomData := OpenRoomResponse{}
+	if err := json.Unmarshal(byts, &openRoomData); err != nil {
+		return nil, fmt.Errorf("decode getOpeningRoom.do: %v: %w", err, ErrUnexpectedResponse)
+	}
+	return openRoomData.Datas.GetOpeningRoom.Rows, nil
+}
+
+// GetCourts 获取场馆中某个项目的所有场地
+func (c *Client) GetCourts(ctx context.Context, q CourtQuery) ([]Court, error) {
+	place := q.Place.WithDefaults()
+	formValues := url.Values{}
+	formValues.Set("YYRQ", q.Slot.Date)
+	formValues.Set("START", q.Slot.YYKS())
+	formValues.Set("END", q.Slot.YYJS())
+	formValues.Set("CGBM", place.Venue)
+	formValues.Set("XMDM", place.Sport)
+	formValues.Set("TYPE", "YY_TT")
+	formValues.Set("YYTYPE", "1.0")
+
+	path := c.CourtsURL
+	if path == "" {
+		path = DefaultCourtsURL
+	}
+	byts, _, err := c.post(ctx, path, formValues, nil)
+	if err != nil {
+		return nil, err
+	}
+	var courts []Court
+	if err := json.Unmarshal(byts, &courts); err != nil {
+		return nil, fmt.Errorf("decode getCdxx.do: %v: %w", err, ErrUnexpectedResponse)
+	}
+	return courts, nil
+}
+
+// InsertVenueBookingInfo 提交预约
+func (c *Client) InsertVenueBookingInfo(ctx context.Context, b Booking) (*InsertResult, error) {
+	byts, _, err := c.post(ctx, "/sportVenue/insertVenueBookingInfo.do", b.Form(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body := string(byts)
+	result := &InsertResult{
+		Success: !strings.Contains(body, "false"),
+		Body:    body,
+	}
+	jq := gojsonq.New().FromString(body)
+	if code, ok := jq.Find("code").(string); ok {
+		result.Code = code
+	}
+	if msg, ok := jq.Reset().Find("msg").(string); ok {
+		result.Msg = msg
+	}
+	return result, nil
+}
+
+// Form 返回提交预约的表单, 没有填写的场馆、项目和校区使用默认值
+func (b Booking) Form() url.Values {
+	place := b.Place.WithDefaults()
+
+	formValues := url.Values{}
+	formValues.Set("DHID", "")
+	formValues.Set("YYRGH", b.UserId)
+	formValues.Set("CYRS", "")
+	formValues.Set("YYRXM", b.UserName)
+	formValues.Set("LXFS", b.PhoneNumber)
+	formValues.Set("CGDM", place.Venue)
+	formValues.Set("CDWID", b.CDWID)
+	formValues.Set("XMDM", place.Sport)
+	formValues.Set("XQWID", place.Campus)
+	formValues.Set("KYYSJD", b.Slot.KYYSJD())
+	formValues.Set("YYRQ", b.Slot.Date)
+	formValues.Set("YYLX", "1.0")
+	formValues.Set("YYKS", b.Slot.YYKS())
+	formValues.Set("YYJS", b.Slot.YYJS())
+	formValues.Set("PC_OR_PHONE", "pc")
+	return formValues
+}
+
+// httpClient 返回使用 Session.Jar 的 http.Client
+func (c *Client) httpClient() *http.Client {
+	httpClient := http.Client{}
+	if c.HTTPClient != nil {
+		httpClient = *c.HTTPClient
+	}
+	if c.Session != nil {
+		httpClient.Jar = c.Session.Jar
+	}
+	return &httpClient
+}
+
+// post 发送带登录 cookie 的表单请求, 返回响应体, ctx 取消时请求立即中断.
+// path 以 http 开头时是完整的地址, 否则相对于 BaseURL
+func (c *Client) post(ctx context.Context, path string, form url.Values, modify func(req *http.Request)) ([]byte, *http.Response, error) {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+
+	target := c.BaseURL + path
+	if strings.HasPrefix(path, "http") {
+		target = path
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", target, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json, text/javascript, */*; q=0.01")
+	req.Header.Set("Connection", "keep-alive")
+
+	// _WEU 和 MOD_AUTH_CAS 由 Session.Jar 带上, 服务器刷新 _WEU 时也会自动更新
+	// no need to modify
+	req.AddCookie(&http.Cookie{Name: "insert_cookie", Value: "28057208"})
+	req.AddCookie(&http.Cookie{Name: "EMAP_LANG", Value: "zh"})
+
+	if modify != nil {
+		modify(req)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	byts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp, fmt.Errorf("read %s: %w", path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return byts, resp, fmt.Errorf("%s: %s: %w", path, resp.Status, ErrServerStatus)
+	}
+	if err := checkAuth(req, resp, byts); err != nil {
+		return byts, resp, fmt.Errorf("%s: %w", path, err)
+	}
+	return byts, resp, nil
+}
+
+// checkAuth 判断登录是否失效: 失效时 ehall 会跳转到 authserver 的登录页
+func checkAuth(req *http.Request, resp *http.Response, body []byte) error {
+	final := resp.Request.URL
+	if final.Host != req.URL.Host || strings.Contains(final.Path, "/authserver/") {
+		return fmt.Errorf("redirected to %s: %w", final.Host+final.Path, ErrAuthExpired)
+	}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] != '{' && trimmed[0] != '[' {
+		return fmt.Errorf("non-JSON response (%s): %w", resp.Header.Get("Content-Type"), ErrAuthExpired)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package ehall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ClockOffset 是服务器时间减去本地时间
+type ClockOffset struct {
+	Offset time.Duration
+	// 误差范围, 真实偏差在 Offset ± Uncertainty 之间
+	Uncertainty time.Duration
+	Samples     int
+}
+
+func (o ClockOffset) String() string {
+	return fmt.Sprintf("%v ± %v (%d samples)", o.Offset, o.Uncertainty, o.Samples)
+}
+
+// clockSample 是一次请求: 本地发出时间, 本地收到时间, 服务器 Date 头
+type clockSample struct {
+	sent     time.Time
+	received time.Time
+	date     time.Time
+}
+
+// MeasureClockOffset 通过 ehall 响应的 Date 头估计服务器和本地的时间偏差.
+// Date 头只精确到秒, 所以每次请求错开 1/samples 秒, 用多次请求的约束缩小误差.
+func (c *Client) MeasureClockOffset(ctx context.Context, samples int) (ClockOffset, error) {
+	if samples <= 0 {
+		samples = 1
+	}
+
+	httpClient := http.Client{
+		// 不跟随跳转, 只看 ehall 自己的 Date
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: 5 * time.Second,
+	}
+	if c.HTTPClient != nil {
+		httpClient.Transport = c.HTTPClient.Transport
+	}
+
+	stagger := time.Second / time.Duration(samples)
+	var results []clockSample
+	var lastErr error
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ClockOffset{}, ctx.Err()
+			case <-time.After(stagger):
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "HEAD", c.BaseURL+"/index.do", nil)
+		if err != nil {
+			return ClockOffset{}, err
+		}
+		sent := time.Now()
+		resp, err := httpClient.Do(req)
+		received := time.Now()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ClockOffset{}, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			lastErr = fmt.Errorf("bad Date header %q: %w", resp.Header.Get("Date"), err)
+			continue
+		}
+		results = append(results, clockSample{sent: sent, received: received, date: date})
+	}
+
+	if len(results) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no samples")
+		}
+		return ClockOffset{}, fmt.Errorf("measure clock offset: %w", lastErr)
+	}
+	return estimateOffset(results), nil
+}
+
+// estimateOffset 合并多次请求的结果.
+// 服务器在 [sent, received] 之间的某个时刻生成了 Date, 且真实时间在 [date, date+1s) 之间,
+// 所以偏差在 [date-received, date+1s-sent] 之间, 多次请求取交集.
+func estimateOffset(samples []clockSample) ClockOffset {
+	var lower, upper time.Duration
+	mids := make([]time.Duration, 0, len(samples))
+	for i, s := range samples {
+		lo := s.date.Sub(s.received)
+		hi := s.date.Add(time.Second).Sub(s.sent)
+		if i == 0 || lo > lower {
+			lower = lo
+		}
+		if i == 0 || hi < upper {
+			upper = hi
+		}
+		mids = append(mids, (lo+hi)/2)
+	}
+
+	if lower <= upper {
+		return ClockOffset{
+			Offset:      (lower + upper) / 2,
+			Uncertainty: (upper - lower) / 2,
+			Samples:     len(samples),
+		}
+	}
+
+	// 网络抖动导致交集为空, 退回到中位数, 误差取单次请求的最大范围
+	sort.Slice(mids, func(i, j int) bool { return mids[i] < mids[j] })
+	var widest time.Duration
+	for _, s := range samples {
+		if w := (s.received.Sub(s.sent) + time.Second) / 2; w > widest {
+			widest = w
+		}
+	}
+	return ClockOffset{
+		Offset:      mids[len(mids)/2],
+		Uncertainty: widest,
+		Samples:     len(samples),
+	}
+}
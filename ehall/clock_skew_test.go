@@ -0,0 +1,29 @@
+package ehall_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"RubCourse/szutest"
+)
+
+func TestMeasureClockOffset(t *testing.T) {
+	for _, skew := range []time.Duration{3 * time.Second, -2 * time.Second} {
+		srv := szutest.NewServer()
+		srv.ClockSkew = skew
+
+		offset, err := srv.EhallClient(nil).MeasureClockOffset(context.Background(), 4)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("skew %v: %v", skew, err)
+		}
+		diff := offset.Offset - skew
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > offset.Uncertainty || offset.Uncertainty > time.Second || offset.Samples != 4 {
+			t.Errorf("skew %v: measured %v", skew, offset)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package ehall
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateOffset(t *testing.T) {
+	t0 := time.Date(2023, 9, 17, 12, 0, 0, 0, time.UTC)
+	sample := func(sent, received, date time.Duration) clockSample {
+		return clockSample{sent: t0.Add(sent), received: t0.Add(received), date: t0.Add(date)}
+	}
+	ms := time.Millisecond
+
+	tests := []struct {
+		name    string
+		samples []clockSample
+		want    ClockOffset
+	}{
+		{
+			// 偏差在 [0-100ms, 1s-0] 之间
+			name:    "single sample",
+			samples: []clockSample{sample(0, 100*ms, 0)},
+			want:    ClockOffset{Offset: 450 * ms, Uncertainty: 550 * ms, Samples: 1},
+		},
+		{
+			// [-100ms, 1s] 和 [200ms, 1.3s] 的交集是 [200ms, 1s]
+			name:    "overlapping intersection",
+			samples: []clockSample{sample(0, 100*ms, 0), sample(700*ms, 800*ms, time.Second)},
+			want:    ClockOffset{Offset: 600 * ms, Uncertainty: 400 * ms, Samples: 2},
+		},
+		{
+			// [-10ms, 1s] 和 [1.99s, 3s] 没有交集, 取中点的中位数, 误差取最大的单次范围
+			name: "empty intersection",
+			samples: []clockSample{
+				sample(0, 10*ms, 0),
+				sample(2*time.Second, 2010*ms, 4*time.Second),
+				sample(0, 10*ms, 0),
+			},
+			want: ClockOffset{Offset: 495 * ms, Uncertainty: 505 * ms, Samples: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateOffset(tt.samples); got != tt.want {
+				t.Errorf("estimateOffset = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
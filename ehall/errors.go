@@ -0,0 +1,12 @@
+package ehall
+
+import "errors"
+
+var (
+	// ErrAuthExpired 表示登录已失效: 请求被跳转到了 authserver, 或者返回的不是 JSON
+	ErrAuthExpired = errors.New("ehall: session expired")
+	// ErrUnexpectedResponse 表示返回的 JSON 和预期的格式不一致
+	ErrUnexpectedResponse = errors.New("ehall: unexpected response")
+	// ErrServerStatus 表示服务器返回了非 2xx 状态码
+	ErrServerStatus = errors.New("ehall: bad status")
+)
@@ -0,0 +1,73 @@
+package ehall
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+)
+
+// Session 是登录后的会话, authserver 和 ehall 的 cookie 都保存在 Jar 中
+type Session struct {
+	Jar http.CookieJar
+}
+
+func NewSession() *Session {
+	// cookiejar.New 只有在 PublicSuffixList 出错时才会返回错误
+	jar, _ := cookiejar.New(nil)
+	return &Session{Jar: jar}
+}
+
+// Cookie 返回发往 rawURL 时会带上的名为 name 的 cookie 值, 没有时为空
+func (s *Session) Cookie(rawURL string, name string) string {
+	if s == nil || s.Jar == nil {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	for _, cookie := range s.Jar.Cookies(u) {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// SavedCookie 是导出保存的 cookie
+type SavedCookie struct {
+	URL   string
+	Name  string
+	Value string
+}
+
+// Export 导出发往 urls 的 cookie, 用于保存会话
+func (s *Session) Export(urls ...string) []SavedCookie {
+	var saved []SavedCookie
+	if s == nil || s.Jar == nil {
+		return saved
+	}
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			continue
+		}
+		for _, cookie := range s.Jar.Cookies(u) {
+			saved = append(saved, SavedCookie{URL: rawURL, Name: cookie.Name, Value: cookie.Value})
+		}
+	}
+	return saved
+}
+
+// RestoreSession 用导出的 cookie 恢复会话
+func RestoreSession(saved []SavedCookie) *Session {
+	session := NewSession()
+	for _, c := range saved {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			continue
+		}
+		session.Jar.SetCookies(u, []*http.Cookie{{Name: c.Name, Value: c.Value, Path: "/"}})
+	}
+	return session
+}
@@ -0,0 +1,145 @@
+package ehall
+
+// DH 是 getOrderNum.do 返回的订单号
+type DH struct {
+	DHID string
+}
+
+// KYY 是 getTimeList.do 返回的一个时间段
+type KYY struct {
+	CODE          string `json:"CODE"`
+	NAME          string `json:"NAME"`
+	STATE_EXPLAIN string `json:"STATE_EXPLAIN"`
+	WID           string `json:"WID"`
+	Disabled      bool   `json:"disabled"`
+	Text          string `json:"text"`
+}
+
+// Available 表示该时间段还可以预约
+func (k KYY) Available() bool {
+	return !k.Disabled && k.Text == TextAvailable
+}
+
+type OpenRoomResponse struct {
+	Code  string   `json:"code"`
+	Datas OpenRoom `json:"datas"`
+}
+
+type OpenRoom struct {
+	GetOpeningRoom OpenRoomObject `json:"getOpeningRoom"`
+}
+
+type OpenRoomObject struct {
+	PageNumber int            `json:"pageNumber"`
+	PageSize   int            `json:"pageSize"`
+	TotalSize  int            `json:"totalSize"`
+	Rows       []OpenRoomData `json:"rows"`
+}
+
+// OpenRoomData 是 getOpeningRoom.do 返回的一个场地
+type OpenRoomData struct {
+	BCRSXZ                string `json:"BCRSXZ"`
+	CDMC                  string `json:"CDMC"`
+	CGBM                  string `json:"CGBM"`
+	CGBM_DISPLAY          string `json:"CGBM_DISPLAY"`
+	DCFS                  string `json:"DCFS"`
+	DCFS_DISPLAY          string `json:"DCFS_DISPLAY"`
+	SCWSDPRS              string `json:"SCWSDPRS"`
+	STATE_EXPLAIN         string `json:"STATE_EXPLAIN"`
+	STATE_EXPLAIN_DISPLAY string `json:"STATE_EXPLAIN_DISPLAY"`
+	WID                   string `json:"WID"`
+	XMDM                  string `json:"XMDM"`
+	XMDM_DISPLAY          string `json:"XMDM_DISPLAY"`
+	XQDM                  string `json:"XQDM"`
+	XQDM_DISPLAY          string `json:"XQDM_DISPLAY"`
+	Disabled              bool   `json:"disabled"`
+	Text                  string `json:"text"`
+}
+
+// Available 表示该场地还可以预约
+func (o OpenRoomData) Available() bool {
+	return !o.Disabled && o.Text == TextAvailable
+}
+
+// Place 返回场地所在的场馆、项目和校区
+func (o OpenRoomData) Place() Place {
+	return Place{Venue: o.CGBM, Sport: o.XMDM, Campus: o.XQDM}
+}
+
+// Place 是场馆、项目和校区的代码, 为空的字段使用默认值
+type Place struct {
+	// 场馆编码 CGBM, 提交预约时是 CGDM
+	Venue string
+	// 项目代码 XMDM
+	Sport string
+	// 校区代码 XQDM, 查询时间段时是 XQ, 提交预约时是 XQWID
+	Campus string
+}
+
+// WithDefaults 把为空的字段换成默认值
+func (p Place) WithDefaults() Place {
+	if p.Venue == "" {
+		p.Venue = DefaultVenue
+	}
+	if p.Sport == "" {
+		p.Sport = DefaultSport
+	}
+	if p.Campus == "" {
+		p.Campus = DefaultCampus
+	}
+	return p
+}
+
+// Court 是 getCdxx.do 返回的一个场地, 和 badmiton.json 的格式相同
+type Court struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// CourtQuery 是查询场地列表的条件
+type CourtQuery struct {
+	Place Place
+	Slot  Slot
+}
+
+// Slot 是一个预约时间段, Date 格式为 2006-01-02, Start/End 格式为 15:04
+type Slot struct {
+	Date  string
+	Start string
+	End   string
+}
+
+// KYYSJD 对应 getTimeList.do 返回的 CODE, 例如 20:00-21:00
+func (s Slot) KYYSJD() string {
+	return s.Start + "-" + s.End
+}
+
+// YYKS 是预约开始时间, 例如 2023-09-17 20:00
+func (s Slot) YYKS() string {
+	return s.Date + " " + s.Start
+}
+
+// YYJS 是预约结束时间, 例如 2023-09-17 21:00
+func (s Slot) YYJS() string {
+	return s.Date + " " + s.End
+}
+
+// Booking 是 insertVenueBookingInfo.do 的表单
+type Booking struct {
+	UserId      string
+	UserName    string
+	PhoneNumber string
+	// 场地ID
+	CDWID string
+	Slot  Slot
+	// 场馆, 项目, 校区, 为空时使用默认值
+	Place Place
+}
+
+// InsertResult 是 insertVenueBookingInfo.do 的返回
+type InsertResult struct {
+	Success bool
+	Code    string
+	Msg     string
+	Body    string
+}
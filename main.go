@@ -1,102 +1,62 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
 	dysmsapi "github.com/alibabacloud-go/dysmsapi-20170525/v3/client"
 	"github.com/alibabacloud-go/tea/tea"
-	"github.com/gocolly/colly/v2"
-	"github.com/gocolly/colly/v2/debug"
 
-	"github.com/robertkrimen/otto"
-	gojsonq "github.com/thedevsaddam/gojsonq/v2"
+	"RubCourse/cas"
+	"RubCourse/ehall"
+	"RubCourse/traffic"
 )
 
-type DH struct {
-	DHID string
-}
-
 type Badminton struct {
 	Id   string `json:"id"`
 	Name string `json:"name"`
 }
 
-type KYY struct {
-	CODE          string `json:"CODE"`
-	NAME          string `json:"NAME"`
-	STATE_EXPLAIN string `json:"STATE_EXPLAIN"`
-	WID           string `json:"WID"`
-	Disabled      bool   `json:"disabled"`
-	Text          string `json:"text"`
-}
-
-type OpenRoomResponse struct {
-	Code  string   `json:"code"`
-	Datas OpenRoom `json:"datas"`
-}
-
-type OpenRoom struct {
-	GetOpeningRoom OpenRoomObject `json:"getOpeningRoom"`
-}
-
-type OpenRoomObject struct {
-	PageNumber int            `json:"pageNumber"`
-	PageSize   int            `json:"pageSize"`
-	TotalSize  int            `json:"totalSize"`
-	Rows       []OpenRoomData `json:"rows"`
-}
-
-type OpenRoomData struct {
-	BCRSXZ                string `json:"BCRSXZ"`
-	CDMC                  string `json:"CDMC"`
-	CGBM                  string `json:"CGBM"`
-	CGBM_DISPLAY          string `json:"CGBM_DISPLAY"`
-	DCFS                  string `json:"DCFS"`
-	DCFS_DISPLAY          string `json:"DCFS_DISPLAY"`
-	SCWSDPRS              string `json:"SCWSDPRS"`
-	STATE_EXPLAIN         string `json:"STATE_EXPLAIN"`
-	STATE_EXPLAIN_DISPLAY string `json:"STATE_EXPLAIN_DISPLAY"`
-	WID                   string `json:"WID"`
-	XMDM                  string `json:"XMDM"`
-	XMDM_DISPLAY          string `json:"XMDM_DISPLAY"`
-	XQDM                  string `json:"XQDM"`
-	XQDM_DISPLAY          string `json:"XQDM_DISPLAY"`
-	Disabled              bool   `json:"disabled"`
-	Text                  string `json:"text"`
+type UserInfo struct {
+	UserId      string
+	UserName    string
+	Password    string
+	PhoneNumber string
+	SportDate   string
+	IfExecNow   string
+	// 任务要预约的时间段 (包括备选) 和完成条件, 不保存到 users 文件
+	Slots  []SlotChoice     `json:"-"`
+	Policy CompletionPolicy `json:"-"`
+	// 任务的时间安排, 不保存到 users 文件
+	Schedule Schedule `json:"-"`
+	// 演练: 选好场地后只打印要提交的表单, 不提交预约
+	DryRun bool `json:"-"`
+	// 用户的场地偏好, 保存到 users 文件
+	Courts CourtPreference
+	// 任务的场地偏好, 没有设置的项使用用户的偏好
+	TaskCourts CourtPreference `json:"-"`
+	// 任务的场馆、项目和校区
+	Place ehall.Place `json:"-"`
 }
 
-type UserInfo struct {
-	UserId       string
-	UserName     string
-	Password     string
-	PhoneNumber  string
-	SportDate    string
-	FirstTime    string
-	SecondTime   string
-	IfExecNow    string
-	WEU          string
-	MOD_AUTH_CAS string
-	firstRound   bool
-	secondRound  bool
+// String 用于日志, 不包含密码
+func (u UserInfo) String() string {
+	return fmt.Sprintf("%s (%s) %s %v", u.UserName, u.UserId, u.SportDate, u.Slots)
 }
 
 type GoroutineInfo struct {
-	// true 表示任务完成，false 表示还在运行
-	FirstStatus  bool
-	SecondStatus bool
 	// Identification of Goroutine
 	Identification int
 	// 学号
@@ -104,146 +64,161 @@ type GoroutineInfo struct {
 	UserName string
 	// 日期
 	ReservationDate string
-	// 场次时间
-	FirstReservationTime  string
-	SecondReservationTime string
+	// 每个时间段的状态
+	Slots []SlotStatus
+	// 完成条件
+	Policy string
+	// 任务状态, 见 taskTransitions
+	State string
+	// 创建、开始登录、结束和最近一次更新的时间
+	CreatedAt  time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+	UpdatedAt  time.Time
+	// 预约尝试的次数
+	Attempts int
+	// 下次抢票时间, 直接运行的任务为空
+	NextFire string
+	// 会话失效后重新登录的次数
+	Relogins int
+	// 演练任务, 不提交预约
+	DryRun bool
+	// 场地偏好
+	Courts string
+	// 场馆、项目和校区
+	Place string
+	// 任务失败的原因
+	Error string
+	// 运行任务的进程, 网页和命令行可以同时运行任务
+	Pid int
 }
 
-var goroutines map[int]*GoroutineInfo
+// OtherProcess 表示任务在其他进程 (例如命令行) 中运行, 这个进程不能停止它
+func (g GoroutineInfo) OtherProcess() bool {
+	return g.Pid != 0 && g.Pid != os.Getpid()
+}
+
+// taskHandle 是正在运行的任务, 任务的状态保存在数据库中
+type taskHandle struct {
+	// 取消任务, 正在进行的请求也会被中断
+	cancel context.CancelFunc
+	// 任务退出后关闭
+	done chan struct{}
+}
+
+// 任务状态
+const (
+	stateScheduled = "等待抢票"
+	stateLoggingIn = "登录中"
+	statePolling   = "抢票中"
+	stateBooked    = "成功"
+	statePartial   = "部分成功"
+	stateFailed    = "失败"
+	stateCancelled = "已取消"
+	stateExpired   = "已过期"
+)
+
+// 任务失败原因, 具体错误用 %w 包装在这些错误上
+var (
+	errNetwork     = errors.New("网络错误")
+	errLoginFailed = errors.New("登录失败")
+	errAuthExpired = errors.New("登录失效")
+	errSlotGone    = errors.New("场次已约满")
+	errRejected    = errors.New("服务器拒绝")
+	errExpired     = errors.New("预约时间已过")
+)
+
+// 登录 authserver, 密码加密和登录页的 encrypt.js 一致
+var casClient = cas.NewClient()
+
+var goroutines map[int]*taskHandle
 var addLock sync.Mutex
-var deleteLock sync.Mutex
-var deleteLock2 sync.Mutex
-var deleteChan chan bool = make(chan bool)
-var deletingFlag bool = false
-var idx int = 0
-
-func getDHID(urls string, user *UserInfo) string {
-	// formValues := url.Values{}
-	// formValues.Set("wid", "15093a7663fa498695608f3d52cca59d")
-	// formDataStr := formValues.Encode()
-	// formDataBytes := []byte(formDataStr)
-	// formBytesReader := bytes.NewReader(formDataBytes)
-
-	req, err := http.NewRequest("POST", urls,
-		nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Accept", "application/json, text/javascript, */*; q=0.01")
-	// request.Header.Add("Accept-Language", "zh-CN,zh;q=0.8,en-US;q=0.5,en;q=0.3")
-	req.Header.Add("Connection", "keep-alive")
-
-	cookie2 := &http.Cookie{Name: "_WEU", Value: user.WEU, HttpOnly: true}
-	cookie9 := &http.Cookie{Name: "MOD_AUTH_CAS", Value: user.MOD_AUTH_CAS, HttpOnly: true}
-	// no need to modify
-	cookie4 := &http.Cookie{Name: "insert_cookie", Value: "28057208", HttpOnly: true}
-	cookie13 := &http.Cookie{Name: "EMAP_LANG", Value: "zh"}
-	req.AddCookie(cookie2)
-	req.AddCookie(cookie4)
-	req.AddCookie(cookie9)
-	req.AddCookie(cookie13)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Fatal(err)
-	}
 
-	byts, err := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
-	dh := DH{}
-	json.Unmarshal(byts, &dh)
+// ehallClient 使用用户当前的登录会话创建 ehall 客户端
+func ehallClient(user *UserInfo) *ehall.Client {
+	return newEhallClient(sessions.Current(user.UserId))
+}
 
-	errno := gojsonq.New().FromString(string(byts)).Find("code")
-	if err != nil {
-		fmt.Println("错误码：", errno)
-	}
+// newEhallClient 创建的客户端访问 casClient 登录的 ehall
+func newEhallClient(session *ehall.Session) *ehall.Client {
+	client := ehall.NewClient(session)
+	client.BaseURL = casClient.EhallURL
+	client.CourtsURL = config.CourtsURL
+	client.HTTPClient = casClient.HTTPClient
+	return client
+}
 
-	return dh.DHID
+// flushStore 在退出前写入排队的记录
+func flushStore() {
+	if err := store.Flush(); err != nil {
+		log.Printf("flush database failed: %v", err)
+	}
 }
 
-func getYY(year int, month int, day int, startTime string, endTime string) (string, string, string, string) {
-	var YYRQ string
-	var KYYSJD string
-	var YYKS string
-	var YYJS string
-	if day >= 10 {
-		if month >= 10 {
-			YYRQ = fmt.Sprintf("%d-%d-%d", year, month, day)
-		} else {
-			YYRQ = fmt.Sprintf("%d-0%d-%d", year, month, day)
+// setupTraffic 把所有请求记录到 recordFile, 或者从 replayFile 回放, 返回关闭记录文件的函数
+func setupTraffic(recordFile, replayFile string) (func(), error) {
+	switch {
+	case replayFile != "":
+		f, err := os.Open(replayFile)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		if month >= 10 {
-			YYRQ = fmt.Sprintf("%d-%d-0%d", year, month, day)
-		} else {
-			YYRQ = fmt.Sprintf("%d-0%d-0%d", year, month, day)
+		defer f.Close()
+		replayer, err := traffic.LoadReplayer(f)
+		if err != nil {
+			return nil, err
 		}
+		casClient.HTTPClient = &http.Client{Transport: replayer}
+		log.Printf("replaying requests from %s", replayFile)
+		return func() {}, nil
+	case recordFile != "":
+		f, err := os.OpenFile(recordFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		casClient.HTTPClient = &http.Client{Transport: traffic.NewRecorder(f, http.DefaultTransport)}
+		log.Printf("recording requests to %s", recordFile)
+		return func() { f.Close() }, nil
 	}
-	KYYSJD = fmt.Sprintf("%s:00-%s:00", startTime, endTime)
-	YYKS = fmt.Sprintf("%s %s:00", YYRQ, startTime)
-	YYJS = fmt.Sprintf("%s %s:00", YYRQ, endTime)
-	return YYRQ, KYYSJD, YYKS, YYJS
+	return func() {}, nil
 }
 
-func getBadmitonData(year int, month int, day int, startTime string, endTime string) []Badminton {
-	var badmitons_data []Badminton
-	// urls := "https://ehall.szu.edu.cn/publicapp/sys/tycgyyxt/sportVenue/getCdxx.do"
-	// YYRQ, _, YYKS, YYJS := getYY(month, day, startTime, endTime)
-
-	// formValues := url.Values{}
-	// formValues.Set("YYRQ", YYRQ)
-	// formValues.Set("START", YYKS)
-	// formValues.Set("END", YYJS)
-	// formValues.Set("CGBM", "002")
-	// formValues.Set("XMDM", "005")
-	// formValues.Set("TYPE", "YY_TT")
-	// formValues.Set("YYTYPE", "1.0")
-	// formDataStr := formValues.Encode()
-	// formDataBytes := []byte(formDataStr)
-	// formBytesReader := bytes.NewReader(formDataBytes)
-
-	// req, err := http.NewRequest("POST", urls,
-	// 	formBytesReader)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	// req.Header.Add("Accept", "application/json, text/javascript, */*; q=0.01")
-	// // request.Header.Add("Accept-Language", "zh-CN,zh;q=0.8,en-US;q=0.5,en;q=0.3")
-	// req.Header.Add("Connection", "keep-alive")
-
-	// cookie2 := &http.Cookie{Name: "_WEU", Value: _WEU, HttpOnly: true}
-	// cookie9 := &http.Cookie{Name: "MOD_AUTH_CAS", Value: MOD_AUTH_CAS, HttpOnly: true}
-	// // no need to modify
-	// cookie4 := &http.Cookie{Name: "insert_cookie", Value: "28057208", HttpOnly: true}
-	// cookie13 := &http.Cookie{Name: "EMAP_LANG", Value: "zh"}
-	// req.AddCookie(cookie2)
-	// req.AddCookie(cookie4)
-	// req.AddCookie(cookie9)
-	// req.AddCookie(cookie13)
-
-	// resp, err := http.DefaultClient.Do(req)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
+func getDHID(ctx context.Context, user *UserInfo) (string, error) {
+	dhID, err := ehallClient(user).GetOrderNum(ctx)
+	if err != nil {
+		return "", ehallError(ctx, err)
+	}
+	return dhID, nil
+}
 
-	// byts, err := ioutil.ReadAll(resp.Body)
-	// defer resp.Body.Close()
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// fmt.Println(string(byts))
-	// json.Unmarshal(byts, &badmitons_data)
+// ehallError 把 ehall 包返回的错误归类为任务失败原因
+func ehallError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	switch {
+	case errors.Is(err, ehall.ErrAuthExpired):
+		return fmt.Errorf("%w: %v", errAuthExpired, err)
+	case errors.Is(err, ehall.ErrUnexpectedResponse), errors.Is(err, ehall.ErrServerStatus):
+		return fmt.Errorf("%w: %v", errRejected, err)
+	default:
+		return fmt.Errorf("%w: %v", errNetwork, err)
+	}
+}
 
-	// errno := gojsonq.New().FromString(string(byts)).Find("code")
-	// if err != nil {
-	// 	fmt.Println("错误码：", errno)
-	// }
+// getBadmitonData 返回抢票使用的场地列表, 优先使用从 getCdxx.do 获取的
+func getBadmitonData(ctx context.Context, user *UserInfo) []Badminton {
+	return catalog.Courts(ctx, user, user.Place)
+}
+
+// courtCatalog 返回缓存的场地列表, 用于页面上选择场地, 不访问网络
+func courtCatalog() []Badminton {
+	return catalog.Cached(ehall.Place{}).Courts
+}
 
+// readBadmintonFile 读取 badmiton.json 中的所有场地
+func readBadmintonFile() []Badminton {
+	var badmitons_data []Badminton
 	filePtr, err := os.Open("./badmiton.json")
 	if err != nil {
 		fmt.Println(err.Error())
@@ -261,93 +236,61 @@ func getBadmitonData(year int, month int, day int, startTime string, endTime str
 	return badmitons_data
 }
 
-func httpRequestDHID(urls string, dhID string, year int, month int, day int, startTime string, endTime string, user *UserInfo) bool {
+// httpRequestDHID 预约时间段, 返回预约成功的场地, 同时提交的几个场地都成功时返回多个
+func httpRequestDHID(ctx context.Context, dhID string, slot ehall.Slot, user *UserInfo) ([]Badminton, error) {
+	// 每个场次使用同一份场地状态快照, 再同时向前几个空闲的场地提交
+	snapshot, err := availabilities.Get(ctx, user, slot)
+	if err != nil {
+		return nil, err
+	}
 
-	badminton := getBadmitonData(year, month, day, startTime, endTime)
-	count := 0
+	badminton := getBadmitonData(ctx, user)
+	if len(badminton) == 0 {
+		// 其他场馆和项目没有 badmiton.json, 场地列表获取失败时使用快照中的场地
+		badminton = snapshot.Courts()
+	}
 	if len(badminton) == 0 {
-		return false
+		fmt.Println("该时间没有空闲的场地")
+		return nil, errSlotGone
 	}
+	// 按场地偏好的顺序尝试
+	badminton = user.TaskCourts.Or(user.Courts).Order(badminton)
+	if len(badminton) == 0 {
+		return nil, errors.New("没有符合场地偏好的场地")
+	}
+	var courts []Badminton
 	for _, value := range badminton {
-		if !getKyydata(value.Id, year, month, day, startTime, endTime, user) {
-			fmt.Printf("没有kyy data ")
-			continue
-		}
-		if count > 2 {
-			fmt.Println("request too much, just rest.")
-			return false
-		}
-		formValues := url.Values{}
-		// formValues.Set("DHID", dhID)
-		formValues.Set("DHID", "")
-		formValues.Set("YYRGH", user.UserId)
-		formValues.Set("CYRS", "")
-		formValues.Set("YYRXM", user.UserName)
-		formValues.Set("LXFS", user.PhoneNumber)
-		formValues.Set("CGDM", "001")
-		// 场地ID, 不固定, 需要读取JSON文件
-		formValues.Set("CDWID", value.Id)
-		formValues.Set("XMDM", "001")
-		formValues.Set("XQWID", "1")
-		// 时间段信息
-		YYRQ, KYYSJD, YYKS, YYJS := getYY(year, month, day, startTime, endTime)
-		formValues.Set("KYYSJD", KYYSJD)
-		formValues.Set("YYRQ", YYRQ)
-		formValues.Set("YYLX", "1.0")
-		formValues.Set("YYKS", YYKS)
-		formValues.Set("YYJS", YYJS)
-		formValues.Set("PC_OR_PHONE", "pc")
-		// 以下信息全固定
-		formDataStr := formValues.Encode()
-		formDataBytes := []byte(formDataStr)
-		formBytesReader := bytes.NewReader(formDataBytes)
-
-		req, err := http.NewRequest("POST", urls,
-			formBytesReader)
-		if err != nil {
-			log.Fatal(err)
-		}
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		req.Header.Add("Accept", "application/json, text/javascript, */*; q=0.01")
-		req.Header.Add("Connection", "keep-alive")
-
-		cookie2 := &http.Cookie{Name: "_WEU", Value: user.WEU, HttpOnly: true}
-		cookie9 := &http.Cookie{Name: "MOD_AUTH_CAS", Value: user.MOD_AUTH_CAS, HttpOnly: true}
-		// no need to modify
-		cookie4 := &http.Cookie{Name: "insert_cookie", Value: "28057208", HttpOnly: true}
-		cookie13 := &http.Cookie{Name: "EMAP_LANG", Value: "zh"}
-		req.AddCookie(cookie2)
-		req.AddCookie(cookie4)
-		req.AddCookie(cookie9)
-		req.AddCookie(cookie13)
-
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		byts, err := ioutil.ReadAll(resp.Body)
-		defer resp.Body.Close()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if strings.Contains(string(byts), "false") {
-			fmt.Println("ERROR: ", string(byts))
-			count++
-		} else {
-			fmt.Println(string(byts), "OK!")
-			return true
+		if snapshot.Free(value.Id) {
+			courts = append(courts, value)
 		}
+	}
+	if len(courts) == 0 {
+		fmt.Println("该时间没有空闲的场地")
+		return nil, errSlotGone
+	}
+	if len(courts) > config.CourtAttempts {
+		courts = courts[:config.CourtAttempts]
+	}
 
-		errno := gojsonq.New().FromString(string(byts)).Find("code")
-		if err != nil {
-			fmt.Println("错误码：", errno)
-			return false
-		}
+	if user.DryRun {
+		printDryRun(courts[0], newBooking(user, courts[0], slot))
+		return courts[:1], nil
 	}
+	return insertCourts(ctx, user, slot, courts)
+}
 
-	return false
+// printDryRun 打印演练时选中的场地和会提交的表单
+func printDryRun(court Badminton, booking ehall.Booking) {
+	fmt.Printf("演练: %s %s 选中场地 %s (%s), 不提交预约\n", booking.Slot.Date, booking.Slot.KYYSJD(), court.Name, court.Id)
+	form := booking.Form()
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %s=%s\n", k, form.Get(k))
+	}
 }
 
 func sendSMSNotification(user *UserInfo, reservationTime string) error {
@@ -391,305 +334,230 @@ func sendSMSNotification(user *UserInfo, reservationTime string) error {
 	return err
 }
 
-func getOpeningRoom(CDWID string, year int, month int, day int, startTime string, endTime string, user *UserInfo) bool {
-	urls := "https://ehall.szu.edu.cn/qljfwapp/sys/lwSzuCgyy/modules/sportVenue/getOpeningRoom.do"
-	YYRQ, _, YYKS, YYJS := getYY(year, month, day, startTime, endTime)
-
-	formValues := url.Values{}
-	formValues.Set("XMDM", "001")
-	formValues.Set("YYRQ", YYRQ)
-	formValues.Set("YYLX", "1.0")
-	formValues.Set("KSSJ", strings.Split(YYKS, " ")[1])
-	formValues.Set("JSSJ", strings.Split(YYJS, " ")[1])
-	formValues.Set("XQDM", "1")
-	// fmt.Println("预约开始", strings.Split(YYKS, " ")[1])
-	// fmt.Println("预约结束", strings.Split(YYJS, " ")[1])
-	// fmt.Println("formValues:", formValues)
-	formDataStr := formValues.Encode()
-	formDataBytes := []byte(formDataStr)
-	formBytesReader := bytes.NewReader(formDataBytes)
-
-	req, err := http.NewRequest("POST", urls,
-		formBytesReader)
+func execRub(ctx context.Context, user *UserInfo, goroutineID int) error {
+	// 订单号目前没有提交, 失败了也继续
+	dhID, err := getDHID(ctx, user)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("get order number failed: %v", err)
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Accept", "application/json, text/javascript, */*; q=0.01")
-	req.Header.Add("Connection", "keep-alive")
-
-	cookie2 := &http.Cookie{Name: "_WEU", Value: user.WEU, HttpOnly: true}
-	cookie9 := &http.Cookie{Name: "MOD_AUTH_CAS", Value: user.MOD_AUTH_CAS, HttpOnly: true}
-	// no need to modify
-	cookie4 := &http.Cookie{Name: "insert_cookie", Value: "28057208", HttpOnly: true}
-	cookie13 := &http.Cookie{Name: "EMAP_LANG", Value: "zh"}
-	req.AddCookie(cookie2)
-	req.AddCookie(cookie4)
-	req.AddCookie(cookie9)
-	req.AddCookie(cookie13)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Fatal(err)
-		return false
+
+	// 满足完成条件后取消其他时间段, 所有时间段都开始后不再抢票
+	slotsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if deadline := slotsDeadline(user); !deadline.IsZero() {
+		var cancelDeadline context.CancelFunc
+		slotsCtx, cancelDeadline = context.WithDeadline(slotsCtx, deadline)
+		defer cancelDeadline()
 	}
 
-	byts, err := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
-	if err != nil {
-		log.Fatal(err)
-		return false
+	// 满足完成条件时已经发出的预约请求继续等结果, 任务取消时才中断
+	slotsCtx = withInsertContext(slotsCtx, ctx)
+	claims := &slotClaims{}
+	results := make(chan bool, len(user.Slots))
+	var wg sync.WaitGroup
+	for i, choice := range user.Slots {
+		wg.Add(1)
+		go func(i int, choice SlotChoice) {
+			defer wg.Done()
+			results <- rubSlot(slotsCtx, user, goroutineID, dhID, i, choice, claims)
+		}(i, choice)
 	}
-	// fmt.Println(string(byts))
-	openRoomData := OpenRoomResponse{}
-	json.Unmarshal(byts, &openRoomData)
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-	// fmt.Println("openRoomData.getOpeningRoom.rows ", openRoomData.Datas.GetOpeningRoom.Rows)
-	for _, v := range openRoomData.Datas.GetOpeningRoom.Rows {
-		// fmt.Println(v.WID, CDWID, v.Disabled, v.Text)
-		if v.WID == CDWID && !v.Disabled && v.Text == "可预约" {
-			return true
+	need := user.Policy.Need(len(user.Slots))
+	booked := 0
+	for ok := range results {
+		if !ok {
+			continue
+		}
+		booked++
+		if booked == need {
+			fmt.Printf("已预约 %d 个时间段, 满足完成条件 (%s)\n", booked, user.Policy)
+			cancel()
 		}
 	}
 
-	return false
-}
-
-func getKyydata(CDWID string, year int, month int, day int, startTime string, endTime string, user *UserInfo) bool {
-	urls := "https://ehall.szu.edu.cn/qljfwapp/sys/lwSzuCgyy/sportVenue/getTimeList.do"
-	YYRQ, KYYSJD, _, _ := getYY(year, month, day, startTime, endTime)
-
-	formValues := url.Values{}
-	formValues.Set("XQ", "1")
-	fmt.Println("YYRQ", YYRQ)
-	formValues.Set("YYRQ", YYRQ)
-	formValues.Set("XMDM", "001")
-	formValues.Set("YYLX", "1.0")
-	formDataStr := formValues.Encode()
-	formDataBytes := []byte(formDataStr)
-	formBytesReader := bytes.NewReader(formDataBytes)
-
-	req, err := http.NewRequest("POST", urls,
-		formBytesReader)
-	if err != nil {
-		log.Fatal(err)
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
-	req.Header.Add("Accept", "*/*")
-	req.Header.Add("Connection", "keep-alive")
-	req.Header.Add("Host", "ehall.szu.edu.cn")
-	req.Header.Add("Origin", "https://ehall.szu.edu.cn")
-	req.Header.Add("Referer", "https://ehall.szu.edu.cn/qljfwapp/sys/lwSzuCgyy/index.do")
-
-	// fmt.Println("WEU", user.WEU)
-	// fmt.Println("MOD_AUTH_CAS", user.MOD_AUTH_CAS)
-	cookie2 := &http.Cookie{Name: "_WEU", Value: user.WEU}
-	cookie9 := &http.Cookie{Name: "MOD_AUTH_CAS", Value: user.MOD_AUTH_CAS}
-	// no need to modify
-	cookie4 := &http.Cookie{Name: "asessionid", Value: "f7d75b63-1d8d-4b30-91c1-3ea268e2a296"}
-	cookie5 := &http.Cookie{Name: "route", Value: "c74f3c8250d849c2cfd6230ee3f779bd"}
-	cookie13 := &http.Cookie{Name: "amp.locale", Value: "undefined"}
-	cookie14 := &http.Cookie{Name: "EMAP_LANG", Value: "zh"}
-	req.AddCookie(cookie2)
-	req.AddCookie(cookie4)
-	req.AddCookie(cookie9)
-	req.AddCookie(cookie13)
-	req.AddCookie(cookie5)
-	req.AddCookie(cookie14)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Fatal(err)
-		return false
+	if booked >= need {
+		return nil
 	}
-
-	byts, err := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
-
-	// fmt.Println("resp.Header: ", resp.Header.Values("Set-Cookie"), len(resp.Header.Values("Set-Cookie")))
-	// fmt.Println()
-	if len(resp.Header.Values("Set-Cookie")) == 1 {
-		user.WEU = strings.Split(strings.Split(resp.Header.Values("Set-Cookie")[0], ";")[0], "=")[1]
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-
-	if err != nil {
-		log.Fatal(err)
-		return false
+	if errors.Is(slotsCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: 只预约成功 %d 个时间段, 需要 %d 个", errExpired, booked, need)
 	}
-	//fmt.Println(string(byts))
-	var kyyData []KYY
-	json.Unmarshal(byts, &kyyData)
+	return fmt.Errorf("只预约成功 %d 个时间段, 需要 %d 个", booked, need)
+}
 
-	for _, v := range kyyData {
-		//fmt.Println(v.CODE, KYYSJD, v.Disabled, v.Text)
-		if v.CODE == KYYSJD && !v.Disabled && v.Text == "可预约" {
-			// time is suitable, and then check the CD if suitable
-			if getOpeningRoom(CDWID, year, month, day, startTime, endTime, user) {
+// rubSlot 不断尝试预约一个时间段或者它的备选, 直到成功或者任务取消, 返回是否成功
+func rubSlot(ctx context.Context, user *UserInfo, goroutineID int, dhID string, i int, choice SlotChoice, claims *slotClaims) bool {
+	// 上一次尝试后重新登录过. 重新登录后马上又失效 (例如返回维护页面) 时要等重试间隔, 不能不停地登录
+	relogged := false
+	for {
+		session := sessions.Current(user.UserId)
+		slot, courts, err := bookChoice(ctx, user, dhID, choice, claims)
+		recordSlot(ctx, goroutineID, i, choice, slot, err)
+		if err == nil {
+			reservationTime := slot.String()
+			if slot != choice[0] {
+				reservationTime = fmt.Sprintf("%s (备选, 首选 %s 已约满)", slot, choice[0])
+			}
+			if user.DryRun {
+				fmt.Println(reservationTime, "success.")
 				return true
-			} else {
-				fmt.Println("该时间该场地已约完，尝试换该时间其他场地中")
-				return false
 			}
-		}
-	}
-
-	errno := gojsonq.New().FromString(string(byts)).Find("code")
-	if err != nil {
-		fmt.Println("错误码：", errno)
-		return false
-	}
-
-	return false
-}
-
-func execRub(user *UserInfo, goroutineID int) bool {
-	dhID := getDHID("https://ehall.szu.edu.cn/qljfwapp/sys/lwSzuCgyy/sportVenue/getOrderNum.do", user)
-
-	// date
-	var year int
-	var month int
-	var day int
-	arr := strings.Split(user.SportDate, "-")
-	year, _ = strconv.Atoi(arr[0])
-	month, _ = strconv.Atoi(arr[1])
-	day, _ = strconv.Atoi(arr[2])
-
-	// first time
-	var startTime int
-	timeArr := strings.Split(user.FirstTime, ":")
-	startTime, _ = strconv.Atoi(timeArr[0])
-	endTime := strconv.Itoa(startTime + 1)
-	if len(endTime) == 1 {
-		endTime = "0" + endTime
-	}
-
-	// second time
-	var timeArr2 []string
-	var endTime2 string
-	if user.SecondTime != "00:00" {
-		timeArr2 = strings.Split(user.SecondTime, ":")
-		startTime2, _ := strconv.Atoi(timeArr2[0])
-		endTime2 = strconv.Itoa(startTime2 + 1)
-		if len(endTime2) == 1 {
-			endTime2 = "0" + endTime2
-		}
-	}
-
-	waitGroup := sync.WaitGroup{}
-	waitGroup.Add(2)
-
-	firstSMSent := false
-	secondSMSent := false
-
-	go func() {
-		for !user.firstRound {
-			success := httpRequestDHID("https://ehall.szu.edu.cn/qljfwapp/sys/lwSzuCgyy/sportVenue/insertVenueBookingInfo.do",
-				dhID, year, month, day, timeArr[0], endTime, user)
-			// return err
-			user.firstRound = success
-			if success && !firstSMSent {
-				if err := sendSMSNotification(user, user.FirstTime); err != nil {
-					log.Printf("send sms for first slot failed: %v", err)
-				}
-				firstSMSent = true
+			// 同时提交的场地可能都成功了, 每个都要记下来, 多余的需要到 ehall 上手动取消
+			if len(courts) > 1 {
+				log.Printf("task %d: %s booked %d courts for %s, cancel the extra ones on ehall", goroutineID, user.UserId, len(courts), slot)
 			}
-			if !user.firstRound {
-				// 被通知需要关闭
-				if goroutines[goroutineID].FirstStatus {
-					user.firstRound = true
+			for _, court := range courts {
+				recordBooking(goroutineID, i, user, slot, court)
+				if err := sendSMSNotification(user, reservationTime+" "+court.Name); err != nil {
+					log.Printf("send sms for %s %s failed: %v", slot, court.Name, err)
 				}
-				fmt.Println("第一轮尝试中...")
-				// 3
-				time.Sleep(3 * time.Second)
+				fmt.Println(reservationTime, court.Name, "success.")
 			}
+			return true
 		}
-		waitGroup.Done()
-		addLock.Lock()
-		goroutines[goroutineID].FirstStatus = true
-		addLock.Unlock()
-		fmt.Println("first round success.")
-	}()
-
-	dhID2 := getDHID("https://ehall.szu.edu.cn/qljfwapp/sys/lwSzuCgyy/sportVenue/getOrderNum.do", user)
-	for !user.secondRound {
-		success := httpRequestDHID("https://ehall.szu.edu.cn/qljfwapp/sys/lwSzuCgyy/sportVenue/insertVenueBookingInfo.do",
-			dhID2, year, month, day, timeArr2[0], endTime2, user)
-		user.secondRound = success
-		if success && !secondSMSent && user.SecondTime != "00:00" {
-			if err := sendSMSNotification(user, user.SecondTime); err != nil {
-				log.Printf("send sms for second slot failed: %v", err)
+		if errors.Is(err, errAuthExpired) {
+			if err := relogin(ctx, user, goroutineID, session); err != nil {
+				recordSlot(ctx, goroutineID, i, choice, slot, err)
+				relogged = false
+			} else if !relogged {
+				relogged = true
+				continue
 			}
-			secondSMSent = true
+		} else {
+			relogged = false
 		}
-		if !success {
+		fmt.Println(choice, "尝试中...", err)
+		select {
+		case <-ctx.Done():
 			// 被通知需要关闭
-			if goroutines[goroutineID].SecondStatus {
-				user.secondRound = true
-			}
-			fmt.Println("第二轮尝试中...")
-			// 3
-			time.Sleep(3 * time.Second)
+			return false
+		case <-time.After(user.Schedule.RetryInterval):
 		}
 	}
-	waitGroup.Done()
-	addLock.Lock()
-	goroutines[goroutineID].SecondStatus = true
-	addLock.Unlock()
-	fmt.Println("second round success.")
-
-	waitGroup.Wait()
+}
 
-	delete(goroutines, goroutineID)
+// bookChoice 查询一次 getTimeList.do, 按顺序预约还可以预约的首选或备选时间段, 返回预约成功的时间段和场地.
+// 一个时间段没有空闲场地时继续尝试下一个
+func bookChoice(ctx context.Context, user *UserInfo, dhID string, choice SlotChoice, claims *slotClaims) (TimeSlot, []Badminton, error) {
+	kyy, err := availabilities.TimeList(ctx, user, user.SportDate, 0)
+	if err != nil {
+		return TimeSlot{}, nil, err
+	}
+	err = errSlotGone
+	for _, slot := range choice {
+		if !slotOpen(kyy, slot.On(user.SportDate)) || !claims.claim(slot) {
+			continue
+		}
+		var courts []Badminton
+		courts, err = httpRequestDHID(ctx, dhID, slot.On(user.SportDate), user)
+		if err == nil {
+			return slot, courts, nil
+		}
+		claims.release(slot)
+		if !errors.Is(err, errSlotGone) {
+			return TimeSlot{}, nil, err
+		}
+	}
+	return TimeSlot{}, nil, err
+}
 
-	if deletingFlag {
-		// 通知删除完成
-		deleteLock.Lock()
-		deleteChan <- true
-		deleteLock.Unlock()
+// relogin 在会话失效时重新登录. 几个时间段同时发现失效时只会登录一次, 也只计一次
+func relogin(ctx context.Context, user *UserInfo, goroutineID int, stale *ehall.Session) error {
+	expired := sessions.Invalidate(user.UserId, stale)
+	if err := getTheToken(ctx, user); err != nil {
+		return err
+	}
+	if !expired {
+		return nil
 	}
 
-	return true
+	updateTask(goroutineID, func(info *GoroutineInfo) {
+		info.Relogins++
+		log.Printf("task %d: session of %s expired, logged in again (%d times)", goroutineID, user.UserId, info.Relogins)
+	})
+	return nil
 }
 
-func callJavascript(password, salt string) string {
-	filePath := "./encrypt.js"
+// recordSlot 记录一次尝试, 并在任务中记下时间段最近一次失败的原因, 成功时清空并记下实际预约的时间段
+func recordSlot(ctx context.Context, goroutineID int, i int, choice SlotChoice, booked TimeSlot, err error) {
+	if ctx.Err() != nil && err != nil {
+		return
+	}
 
-	bytes, err := ioutil.ReadFile(filePath)
+	attempt := attemptRecord{TaskId: goroutineID, Time: time.Now(), Slot: choice.String()}
 	if err != nil {
-		panic(err)
+		attempt.Error = err.Error()
+	} else {
+		attempt.Slot = booked.String()
 	}
+	store.AddAttempt(attempt)
 
-	vm := otto.New()
+	updateTask(goroutineID, func(info *GoroutineInfo) {
+		info.Attempts++
+		info.UpdatedAt = attempt.Time
+		if i >= len(info.Slots) {
+			return
+		}
+		if err != nil {
+			info.Slots[i].Error = err.Error()
+			return
+		}
+		info.Slots[i].Error = ""
+		info.Slots[i].Booked = true
+		info.Slots[i].BookedSlot = booked.String()
+		info.Slots[i].Fallback = booked != choice[0]
+	})
+}
 
-	_, err = vm.Run(string(bytes))
-	if err != nil {
-		panic(err)
-	}
+// recordBooking 记录预约成功的场地, 并在任务的第 i 个时间段中记下场地
+func recordBooking(goroutineID int, i int, user *UserInfo, slot TimeSlot, court Badminton) {
+	store.AddBooking(bookingRecord{
+		TaskId:    goroutineID,
+		UserId:    user.UserId,
+		UserName:  user.UserName,
+		Date:      user.SportDate,
+		Slot:      slot.String(),
+		CourtId:   court.Id,
+		CourtName: court.Name,
+		Place:     placeLabel(user.Place),
+		Time:      time.Now(),
+	})
+	updateTask(goroutineID, func(info *GoroutineInfo) {
+		if i < len(info.Slots) {
+			info.Slots[i].Courts = append(info.Slots[i].Courts, court.Name)
+		}
+	})
+}
 
-	value, err := vm.Call("encryptAES", nil, password, salt)
-	if err != nil {
-		panic(err)
-	}
-	// fmt.Println(value.String())
-	return value.String()
+// updateTask 修改数据库中任务的状态, 修改先排队, 不等待数据库, 失败时只记录日志
+func updateTask(goroutineID int, fn func(info *GoroutineInfo)) {
+	store.QueueTaskUpdate(goroutineID, fn)
 }
 
 func process(w http.ResponseWriter, r *http.Request) {
 	t := template.Must(template.ParseFiles("./templates/tmpl.html"))
 
-	dataEncoded, err := ioutil.ReadFile("users")
+	users, err := listUsers()
 	if err != nil {
-		panic(err)
+		log.Printf("load users failed: %v", err)
 	}
-	var usersDecode []*UserInfo
-	json.Unmarshal(dataEncoded, &usersDecode)
 
 	if r.Method != http.MethodPost {
 		t.Execute(w, struct {
 			Result   bool
 			Message  string
-			UserInfo []*UserInfo
-		}{false, "", usersDecode})
+			UserInfo []userSummary
+			Config   Config
+			Courts   []Badminton
+			Places   []knownPlace
+		}{false, "", users, config, courtCatalog(), catalog.Places()})
 		return
 	}
 
@@ -699,371 +567,505 @@ func process(w http.ResponseWriter, r *http.Request) {
 		Password:    r.FormValue("password"),
 		PhoneNumber: r.FormValue("phone_number"),
 		SportDate:   r.FormValue("sportDate"),
-		FirstTime:   r.FormValue("firstTime"),
-		SecondTime:  r.FormValue("secondTime"),
 		IfExecNow:   r.FormValue("ifExecuteNow"),
+		DryRun:      r.FormValue("dryRun") != "",
+	}
+	// 选择了保存的用户时只传学号, 密码从加密文件中读取
+	err = nil
+	if id := r.FormValue("stored_user"); id != "" {
+		var stored *UserInfo
+		if stored, err = findUser(id); err == nil {
+			user.UserId, user.UserName, user.Password, user.PhoneNumber = stored.UserId, stored.UserName, stored.Password, stored.PhoneNumber
+		}
+	}
+	for _, v := range users {
+		if v.UserId == user.UserId {
+			user.Courts = v.Courts
+		}
 	}
 
 	fmt.Println(user)
 
 	var result = false
+	var message = stateFailed
 
-	if user.UserId != "" && user.UserName != "" && user.Password != "" {
-		tempId := 0
-		addLock.Lock()
-		// 添加goroutine信息
-		newGoroutine := GoroutineInfo{
-			FirstStatus:           false,
-			SecondStatus:          false,
-			Identification:        idx,
-			UserId:                user.UserId,
-			UserName:              user.UserName,
-			ReservationDate:       user.SportDate,
-			FirstReservationTime:  user.FirstTime,
-			SecondReservationTime: user.SecondTime,
+	if err == nil {
+		user.Schedule, err = parseSchedule(r.FormValue("releaseTime"), r.FormValue("loginLead"), r.FormValue("retryInterval"))
+	}
+	if err == nil {
+		user.Slots, user.Policy, err = slotsFromForm(r)
+	}
+	if err == nil {
+		user.TaskCourts, err = parseCourtPreference(r.FormValue("courtsRanked"), r.FormValue("courtsInclude"), r.FormValue("courtsExclude"))
+	}
+	if err == nil {
+		user.Place, err = resolvePlace(r.FormValue("venue"), r.FormValue("sport"), r.FormValue("campus"))
+	}
+	if err != nil {
+		message = stateFailed + ": " + err.Error()
+	} else if user.UserId != "" && user.UserName != "" && user.Password != "" {
+		// 任务不跟随浏览器请求, 只能通过 /stop 取消
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		tempId, err := registerGoroutine(&user, cancel)
+		if err == nil {
+			err = startRub(ctx, &user, tempId)
+			unregisterGoroutine(tempId, err)
+		}
+		result = err == nil
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("task %d failed: %v", tempId, err)
+			message = stateFailed + ": " + err.Error()
+		}
+		if info, err := store.Task(tempId); err == nil {
+			message = taskMessage(info)
 		}
-		tempId = idx
-		goroutines[idx] = &newGoroutine
-		idx++
-		addLock.Unlock()
-
-		result = startRub(&user, tempId)
 	}
 
 	if result {
 		t.Execute(w, struct {
 			Result   bool
 			Message  string
-			UserInfo []*UserInfo
-		}{result, "成功", usersDecode})
+			UserInfo []userSummary
+			Config   Config
+			Courts   []Badminton
+			Places   []knownPlace
+		}{result, message, users, config, courtCatalog(), catalog.Places()})
 	} else {
 		t.Execute(w, struct {
 			Result   bool
 			Message  string
-			UserInfo []*UserInfo
-		}{result, "失败", usersDecode})
+			UserInfo []userSummary
+			Config   Config
+			Courts   []Badminton
+			Places   []knownPlace
+		}{result, message, users, config, courtCatalog(), catalog.Places()})
 	}
 }
 
 func add(w http.ResponseWriter, r *http.Request) {
 	t := template.Must(template.ParseFiles("./templates/add.html"))
 
-	if r.Method != http.MethodPost {
-		dataEncoded, err := ioutil.ReadFile("users")
-		if err != nil {
-			panic(err)
-		}
-		var usersDecode []*UserInfo
-		json.Unmarshal(dataEncoded, &usersDecode)
-		if len(usersDecode) == 0 {
-			log.Println("Users information are nil")
-			t.Execute(w, nil)
-		} else {
-			fmt.Printf("Have %d users\n", len(usersDecode))
-			t.Execute(w, struct {
-				ErrorHave bool
-				Already   []*UserInfo
-			}{false, usersDecode})
-		}
+	errorHave, message := false, ""
+	if r.Method == http.MethodPost {
+		errorHave, message = manageUser(r)
 	}
 
-	// get the already information
-	alreadyDataEncode, err := ioutil.ReadFile("users")
+	users, err := listUsers()
 	if err != nil {
-		panic(err)
+		log.Printf("load users failed: %v", err)
 	}
-	var alreadyUsersDecode []*UserInfo
-	json.Unmarshal(alreadyDataEncode, &alreadyUsersDecode)
-
-	newUser := UserInfo{
-		UserId:      r.FormValue("user_id"),
-		UserName:    r.FormValue("user_name"),
-		Password:    r.FormValue("password"),
-		PhoneNumber: r.FormValue("phone_number"),
+	if len(users) == 0 {
+		log.Println("Users information are nil")
+	} else {
+		fmt.Printf("Have %d users\n", len(users))
 	}
+	t.Execute(w, struct {
+		ErrorHave bool
+		Message   string
+		Already   []userSummary
+		Courts    []Badminton
+	}{errorHave, message, users, courtCatalog()})
+}
 
+// manageUser 处理 /add 页面上的新增、修改、删除和验证密码, 返回是否是重复的用户和要显示的结果
+func manageUser(r *http.Request) (bool, string) {
+	userId := r.FormValue("user_id")
 	// when a link to /add, it will take a POST method, skip that
-	if newUser.UserId == "" {
+	if userId == "" {
 		fmt.Println("SKIP")
-		return
+		return false, ""
 	}
 
-	for _, v := range alreadyUsersDecode {
-		if v.UserId == newUser.UserId {
-			fmt.Println("already have this user")
-			t.Execute(w, struct {
-				ErrorHave bool
-				Already   []*UserInfo
-			}{true, alreadyUsersDecode})
-			return
+	switch action := r.FormValue("action"); action {
+	case "delete":
+		if err := deleteUser(userId); err != nil {
+			return false, "删除失败: " + err.Error()
 		}
+		return false, "已删除 " + userId
+	case "verify":
+		if err := verifyCredentials(r.Context(), userId); err != nil {
+			return false, "验证失败: " + err.Error()
+		}
+		return false, userId + " 登录成功"
 	}
 
-	fmt.Println("newUser", newUser)
-
-	alreadyUsersDecode = append(alreadyUsersDecode, &newUser)
-	data, err := json.Marshal(alreadyUsersDecode)
-	if err != nil {
-		panic(err)
+	user := UserInfo{
+		UserId:      userId,
+		UserName:    r.FormValue("user_name"),
+		Password:    r.FormValue("password"),
+		PhoneNumber: r.FormValue("phone_number"),
 	}
-	// add the new information to the file
-	err = ioutil.WriteFile("users", data, 0644)
+	courts, err := parseCourtPreference(r.FormValue("courtsRanked"), r.FormValue("courtsInclude"), r.FormValue("courtsExclude"))
 	if err != nil {
-		panic(err)
+		return false, err.Error()
 	}
+	user.Courts = courts
 
-	t.Execute(w, struct {
-		ErrorHave bool
-		Already   []*UserInfo
-	}{false, alreadyUsersDecode})
+	fmt.Println("newUser", user)
+
+	// 密码加密后保存
+	if r.FormValue("action") == "edit" {
+		if err := updateUser(&user); err != nil {
+			return false, "修改失败: " + err.Error()
+		}
+		return false, "已修改 " + userId
+	}
+	if err := addUser(&user); errors.Is(err, errUserExists) {
+		fmt.Println("already have this user")
+		return true, ""
+	} else if err != nil {
+		return false, "新增失败: " + err.Error()
+	}
+	return false, "已新增 " + userId
 }
 
-func getTheToken(user *UserInfo) {
-	writer, err := os.OpenFile("collector.log", os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		panic(err)
+func getTheToken(ctx context.Context, user *UserInfo) error {
+	if _, err := sessions.Get(ctx, user); err != nil {
+		return loginError(ctx, err)
 	}
+	fmt.Println("登录成功:", user.UserName)
+	return nil
+}
 
-	// create a new collector
-	c := colly.NewCollector(colly.Debugger(&debug.LogDebugger{Output: writer}), colly.MaxDepth(2))
+// loginError 把登录返回的错误归类为任务失败原因
+func loginError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(err, cas.ErrLoginForm) || errors.Is(err, cas.ErrLoginRejected) {
+		return fmt.Errorf("%w: %v", errLoginFailed, err)
+	}
+	return ehallError(ctx, err)
+}
 
-	// attributes
-	var lt string
-	var dllt string
-	var execution string
-	var _eventId string
-	// var rmShown string
-	var pwdDefaultEncryptSalt string
+// verifyCredentials 用保存的密码重新登录一次 CAS, 不复用已有的会话
+func verifyCredentials(ctx context.Context, userId string) error {
+	user, err := findUser(userId)
+	if err != nil {
+		return err
+	}
+	if _, err := casClient.Login(ctx, user.UserId, user.Password); err != nil {
+		return loginError(ctx, err)
+	}
+	return nil
+}
 
-	// Find and visit all links
-	c.OnHTML("form#pwdFromId", func(e *colly.HTMLElement) {
-		selection := e.DOM
+func startRub(ctx context.Context, user *UserInfo, goroutineID int) error {
+	if len(user.Slots) == 0 {
+		return errors.New("没有要预约的时间段")
+	}
+	if deadline := slotsDeadline(user); !deadline.IsZero() && time.Now().After(deadline) {
+		return fmt.Errorf("%w: %s 的时间段都已经开始", errExpired, user.SportDate)
+	}
 
-		ltTemp, ok := selection.Find("input[name=lt]").Attr("value")
-		if !ok {
-			fmt.Println("Not OK in lt")
-			return
-		}
-		lt = ltTemp
-		dlltTemp, ok := selection.Find("input[name=dllt]").Attr("value")
-		if !ok {
-			fmt.Println("Not OK in dllt")
-			return
-		}
-		dllt = dlltTemp
-		executionTemp, ok := selection.Find("input[name=execution]").Attr("value")
-		if !ok {
-			fmt.Println("Not OK in execution")
-			return
-		}
-		execution = executionTemp
-		_eventIdTemp, ok := selection.Find("input[name=_eventId]").Attr("value")
-		if !ok {
-			fmt.Println("Not OK in _eventId")
-			return
+	if user.IfExecNow != "" {
+		fmt.Println("抢票中...")
+		setTaskState(goroutineID, stateLoggingIn)
+		if err := getTheToken(ctx, user); err != nil {
+			return err
 		}
-		_eventId = _eventIdTemp
-		//rmShownTemp, ok := selection.Find("input[name=rmShown]").Attr("value")
-		//if !ok {
-		//	fmt.Println("Not OK in rmShown")
-		//	return
-		//}
-		//rmShown = rmShownTemp
-		pwdDefaultEncryptSaltTemp, ok := selection.Find("input#pwdEncryptSalt").Attr("value")
-		if !ok {
-			fmt.Println("Not OK in pwdDefaultEncryptSalt")
-			return
+		setTaskState(goroutineID, statePolling)
+		err := execRub(ctx, user, goroutineID)
+		fmt.Println("抢票结束...")
+		return err
+	}
+
+	// 提前登录, 到放票时间再开始抢. login 和 release 都是服务器时间
+	offset := measureClockOffset(ctx)
+	login, release := user.Schedule.Next(time.Now().Add(offset))
+	setNextFire(goroutineID, release)
+	fmt.Println("下次抢票时间:", release.Format("2006-01-02 15:04:05"), "登录时间:", login.Format("15:04:05"))
+
+	// 等待时间较长时本地时钟可能漂移, 登录前一分钟再校准一次
+	if time.Until(login.Add(-offset)) > 2*time.Minute {
+		if err := waitUntil(ctx, login.Add(-offset-time.Minute)); err != nil {
+			fmt.Println("任务已取消, 不再等待抢票时间")
+			return err
 		}
-		pwdDefaultEncryptSalt = pwdDefaultEncryptSaltTemp
+		offset = measureClockOffset(ctx)
+	}
 
-	})
+	if err := waitUntil(ctx, login.Add(-offset)); err != nil {
+		fmt.Println("任务已取消, 不再等待抢票时间")
+		return err
+	}
 
-	ehallUrl := "https://authserver.szu.edu.cn/authserver/login?service=https%3A%2F%2Fehall.szu.edu.cn%3A443%2Fqljfwapp%2Fsys%2FlwSzuCgyy%2Findex.do%23%2FsportVenue"
-	c.Request("GET", ehallUrl, nil, nil, nil)
-	c.Wait()
+	fmt.Println("开始登录...")
+	setTaskState(goroutineID, stateLoggingIn)
+	if err := getTheToken(ctx, user); err != nil {
+		return err
+	}
+	// 放票前准备好场地列表, 需要刷新时不占用放票后的时间
+	getBadmitonData(ctx, user)
 
-	// get the encrypt password
-	password := callJavascript(user.Password, pwdDefaultEncryptSalt)
-	// fmt.Println("Start Login...", lt, dllt, execution, _eventId, rmShown, pwdDefaultEncryptSalt, password)
-	fmt.Println()
+	if err := waitUntil(ctx, release.Add(-offset)); err != nil {
+		return err
+	}
 
-	c.OnRequest(func(r *colly.Request) {
-		r.Headers.Set("Content-Type", "application/x-www-form-urlencoded")
-	})
+	fmt.Println("开始抢票...")
+	setTaskState(goroutineID, statePolling)
+	err := execRub(ctx, user, goroutineID)
+	fmt.Println("抢票结束...")
+	return err
+}
 
-	firstDone := false
-
-	c.OnResponse(func(r *colly.Response) {
-		// 这里有两个WEU，直接使用最后一个试试
-		log.Println("Set-Cookie ", r.Headers.Values("Set-Cookie"))
-		fmt.Println()
-
-		cookies := r.Request.Headers.Get("Cookie")
-		log.Println("Cookie: ", cookies)
-		fmt.Println()
-
-		modAuthCas := strings.Split(cookies[strings.Index(cookies, "MOD_AUTH_CAS"):], "=")
-		if len(modAuthCas) == 2 && modAuthCas[0] == "MOD_AUTH_CAS" {
-			user.MOD_AUTH_CAS = modAuthCas[1]
-			fmt.Println("Set the MOD_AUTH_CAS: ", user.MOD_AUTH_CAS)
-			fmt.Println()
-			fmt.Println("Headers", r.Headers.Values("Set-Cookie"), len(r.Headers.Values("Set-Cookie")))
-			fmt.Println("Testing", r.Headers.Values("Set-Cookie")[0])
-			fmt.Println()
-			if !firstDone {
-				user.WEU = strings.Split(strings.Split(r.Headers.Values("Set-Cookie")[0], ";")[0], "=")[1]
-				fmt.Println("get the first WEU: ", user.WEU)
-				firstDone = true
-			}
-		}
-	})
+// waitUntil 等到本地时间 t, 任务取消时立即返回
+func waitUntil(ctx context.Context, t time.Time) error {
+	// 创建定时器
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	// login post
-	err = c.Post("https://authserver.szu.edu.cn/authserver/login?service=https%3A%2F%2Fehall.szu.edu.cn%3A443%2Fqljfwapp%2Fsys%2FlwSzuCgyy%2Findex.do%23%2FsportVenue",
-		map[string]string{"username": user.UserId, "password": password, "lt": lt, "dllt": dllt, "execution": execution, "_eventId": _eventId})
+// measureClockOffset 估计 ehall 服务器时间减去本地时间, 失败时按本地时间抢票
+func measureClockOffset(ctx context.Context) time.Duration {
+	if !config.ClockSync {
+		return 0
+	}
+	offset, err := newEhallClient(nil).MeasureClockOffset(ctx, config.ClockSamples)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("clock sync failed, using local clock: %v", err)
+		return 0
 	}
+	log.Printf("ehall clock offset: %v", offset)
+	return offset.Offset
+}
 
-	c.Wait()
-
-	// get the temp final WEU
-	tempFinalDone := false
-	configUrl := "https://ehall.szu.edu.cn/qljfwapp/sys/lwSzuCgyy/index.do"
-
-	c.OnRequest(func(r *colly.Request) {
-		r.URL.Host = "ehall.szu.edu.cn"
-		r.Headers.Del("Cookie")
-		cookieString := "_WEU=" + user.WEU + ";" + "MOD_AUTH_CAS=" + user.MOD_AUTH_CAS
-		fmt.Println("0 cookieString: ", cookieString)
-		r.Headers.Add("Cookie", cookieString)
+// setNextFire 在状态页上显示下次抢票时间
+func setNextFire(goroutineID int, next time.Time) {
+	updateTask(goroutineID, func(info *GoroutineInfo) {
+		info.NextFire = next.Format("2006-01-02 15:04:05")
 	})
+}
 
-	c.OnResponse(func(r *colly.Response) {
-		fmt.Println("Temp Final CONFIG", r.Headers.Values("Set-Cookie"), len(r.Headers.Values("Set-Cookie")))
+func stop(w http.ResponseWriter, r *http.Request) {
+	t := template.Must(template.ParseFiles("./templates/stopGoroutine.html"))
 
-		if len(r.Headers.Values("Set-Cookie")) == 1 {
-			fmt.Println("Temp Final CONFIG", r.Headers.Values("Set-Cookie")[0])
-			if !tempFinalDone {
-				user.WEU = strings.Split(strings.Split(r.Headers.Values("Set-Cookie")[0], ";")[0], "=")[1]
-				fmt.Println("get the temp final WEU: ", user.WEU)
-				fmt.Println()
-				tempFinalDone = true
-			}
-		} else {
-			fmt.Println("Temp Final CONFIG", r.Headers.Values("Set-Cookie")[0])
-			fmt.Println("Temp Final CONFIG", r.Headers.Values("Set-Cookie")[1])
-			fmt.Println(strings.Split(r.Headers.Values("Set-Cookie")[1], ";"), len(strings.Split(r.Headers.Values("Set-Cookie")[1], ";")))
-
-			if !tempFinalDone {
-				user.WEU = strings.Split(strings.Split(r.Headers.Values("Set-Cookie")[1], ";")[0], "=")[1]
-				fmt.Println("get the temp final WEU: ", user.WEU)
-				fmt.Println()
-				tempFinalDone = true
-			}
-		}
+	if r.Method != http.MethodPost {
+		t.Execute(w, struct {
+			Infos     []GoroutineInfo
+			Cancelled *GoroutineInfo
+			Message   string
+		}{runningGoroutines(), nil, ""})
+		return
+	}
 
-	})
+	// fmt.Println("identification", r.FormValue("identification"))
+
+	// when a link to /stop, it will take a POST method, skip that
+	if r.FormValue("user_id") == "" {
+		fmt.Println("stop skip")
+		return
+	}
 
-	c.Request("GET", configUrl, nil, nil, nil)
+	id, err := strconv.Atoi(r.FormValue("identification"))
+	if err != nil {
+		http.Error(w, "bad identification", http.StatusBadRequest)
+		return
+	}
 
-	c.Wait()
+	addLock.Lock()
+	handle, ok := goroutines[id]
+	addLock.Unlock()
 
-	fmt.Println(c)
+	var cancelled *GoroutineInfo
+	var message string
+	if ok {
+		handle.cancel()
+		// 等待任务退出, 正在进行的请求会被立即中断
+		<-handle.done
+		if info, err := store.Task(id); err == nil {
+			cancelled = &info
+		}
+	} else if info, err := store.Task(id); err == nil && info.OtherProcess() {
+		message = fmt.Sprintf("该任务由其他进程 (pid %d) 运行, 无法从网页停止", info.Pid)
+	}
 
-	// time.Sleep(30 * time.Second)
+	t.Execute(w, struct {
+		Infos     []GoroutineInfo
+		Cancelled *GoroutineInfo
+		Message   string
+	}{runningGoroutines(), cancelled, message})
 }
 
-func startRub(user *UserInfo, goroutineID int) bool {
-	if user.SecondTime == "00:00" {
-		user.secondRound = true
-	}
+// tasks 显示已经结束的任务, 新的在前. 带 id 时显示这个任务的每次尝试和预约到的场地
+func tasks(w http.ResponseWriter, r *http.Request) {
+	t := template.Must(template.ParseFiles("./templates/tasks.html"))
 
-	if user.IfExecNow != "" {
-		fmt.Println("抢票中...")
-		getTheToken(user)
-		result := execRub(user, goroutineID)
-		fmt.Println("抢票结束...")
-		return result
+	var message string
+	var finished []GoroutineInfo
+	all, err := store.Tasks()
+	if err != nil {
+		message = err.Error()
 	}
-
-	// 每天的执行时间
-	hour := 12
-	minute := 29
-	second := 56
-	now := time.Now()
-	next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, second, 0, now.Location())
-	if now.After(next) {
-		// 如果当前已经是预设的时间之后，计算下一个时刻(明天这个点)
-		next = next.Add(24 * time.Hour)
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].Finished() {
+			finished = append(finished, all[i])
+		}
 	}
-	duration := next.Sub(now)
-	// 创建定时器
-	timer := time.NewTicker(duration)
-	defer timer.Stop()
-	// 定时调用
-	for {
-		select {
-		case <-timer.C:
-			fmt.Println("开始抢票...")
-			getTheToken(user)
-			execRub(user, goroutineID)
-			fmt.Println("抢票结束...")
-			return true
+
+	var task *GoroutineInfo
+	var attempts []attemptRecord
+	var bookings []bookingRecord
+	if idText := r.FormValue("id"); idText != "" {
+		id, err := strconv.Atoi(idText)
+		if err != nil {
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		info, err := store.Task(id)
+		if err == nil {
+			task = &info
+			attempts, err = store.Attempts(id)
+		}
+		var allBookings []bookingRecord
+		if err == nil {
+			allBookings, err = store.Bookings()
+		}
+		for _, v := range allBookings {
+			if v.TaskId == id {
+				bookings = append(bookings, v)
+			}
+		}
+		if err != nil {
+			message = err.Error()
 		}
 	}
+
+	t.Execute(w, struct {
+		Tasks    []GoroutineInfo
+		Task     *GoroutineInfo
+		Attempts []attemptRecord
+		Bookings []bookingRecord
+		Error    string
+	}{finished, task, attempts, bookings, message})
 }
 
-func stop(w http.ResponseWriter, r *http.Request) {
-	t := template.Must(template.ParseFiles("./templates/stopGoroutine.html"))
+// courts 显示场地列表, POST 时用选中的用户登录并从服务器刷新
+func courts(w http.ResponseWriter, r *http.Request) {
+	t := template.Must(template.ParseFiles("./templates/courts.html"))
 
-	if r.Method != http.MethodPost {
-		goroutinesInfo := make([]GoroutineInfo, 0)
+	users, err := listUsers()
+	if err != nil {
+		log.Printf("load users failed: %v", err)
+	}
 
-		for _, v := range goroutines {
-			goroutinesInfo = append(goroutinesInfo, *v)
+	var diff *courtDiff
+	var message string
+	if r.Method == http.MethodPost {
+		place, err := resolvePlace(r.FormValue("venue"), r.FormValue("sport"), "")
+		if err == nil {
+			var d courtDiff
+			d, err = refreshCatalog(r.Context(), r.FormValue("user_id"), place)
+			diff = &d
+		}
+		if err != nil {
+			message = err.Error()
+			diff = nil
 		}
-
-		t.Execute(w, struct {
-			Infos []GoroutineInfo
-		}{goroutinesInfo})
-		return
 	}
 
-	// fmt.Println("identification", r.FormValue("identification"))
+	t.Execute(w, struct {
+		Entries []catalogEntry
+		Places  []knownPlace
+		Users   []userSummary
+		Diff    *courtDiff
+		Error   string
+	}{catalog.Entries(), catalog.Places(), users, diff, message})
+}
 
-	// when a link to /stop, it will take a POST method, skip that
-	if r.FormValue("user_id") == "" {
-		fmt.Println("stop skip")
-		return
+// refreshCatalog 用保存的用户登录, 刷新场馆中某个项目的场地列表, 返回和刷新前的区别
+func refreshCatalog(ctx context.Context, userId string, place ehall.Place) (courtDiff, error) {
+	user, err := findUser(userId)
+	if err != nil {
+		return courtDiff{}, err
 	}
-
-	id, err := strconv.Atoi(r.FormValue("identification"))
+	if err := getTheToken(ctx, user); err != nil {
+		return courtDiff{}, err
+	}
+	old := catalog.Cached(place)
+	entry, err := catalog.Refresh(ctx, user, place)
 	if err != nil {
-		log.Fatal(err)
+		return courtDiff{}, err
 	}
+	return diffCourts(old.Courts, entry.Courts), nil
+}
 
-	goroutines[id].FirstStatus = true
-	goroutines[id].SecondStatus = true
+// registerGoroutine 在数据库中保存新任务并返回任务 ID, 任务结束后需要调用 unregisterGoroutine
+func registerGoroutine(user *UserInfo, cancel context.CancelFunc) (int, error) {
+	slots := make([]SlotStatus, len(user.Slots))
+	for i, v := range user.Slots {
+		slots[i] = SlotStatus{Slot: v.String()}
+	}
+	params, err := sealTask(user)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	info := &GoroutineInfo{
+		UserId:          user.UserId,
+		UserName:        user.UserName,
+		ReservationDate: user.SportDate,
+		Slots:           slots,
+		Policy:          user.Policy.String(),
+		State:           stateScheduled,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		DryRun:          user.DryRun,
+		Courts:          user.TaskCourts.Or(user.Courts).String(),
+		Place:           placeLabel(user.Place),
+		Pid:             os.Getpid(),
+	}
 
-	// 等待删除完成
-	deleteLock2.Lock()
-	deletingFlag = true
-	select {
-	case <-deleteChan:
+	if err := store.CreateTask(info, params); err != nil {
+		return 0, fmt.Errorf("save task: %w", err)
 	}
-	deletingFlag = false
-	deleteLock2.Unlock()
+	addHandle(info.Identification, cancel)
+	return info.Identification, nil
+}
+
+// addHandle 记录正在运行的任务, /stop 用 cancel 取消任务
+func addHandle(goroutineID int, cancel context.CancelFunc) {
+	addLock.Lock()
+	defer addLock.Unlock()
+	goroutines[goroutineID] = &taskHandle{cancel: cancel, done: make(chan struct{})}
+}
 
-	goroutinesInfo := make([]GoroutineInfo, 0)
+// unregisterGoroutine 按任务的结果记录结束状态, 删除保存的任务参数
+func unregisterGoroutine(goroutineID int, err error) {
+	finish := func(info *GoroutineInfo) {
+		if terr := info.transition(finalState(info, err), time.Now()); terr != nil {
+			log.Printf("task %d: %v", goroutineID, terr)
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			info.Error = err.Error()
+		}
+	}
+	if err := store.FinishTask(goroutineID, finish); err != nil {
+		log.Printf("finish task %d failed: %v", goroutineID, err)
+	}
 
-	for _, v := range goroutines {
-		goroutinesInfo = append(goroutinesInfo, *v)
+	addLock.Lock()
+	defer addLock.Unlock()
+	if handle, ok := goroutines[goroutineID]; ok {
+		delete(goroutines, goroutineID)
+		close(handle.done)
 	}
+}
 
-	t.Execute(w, struct {
-		Infos []GoroutineInfo
-	}{goroutinesInfo})
+func runningGoroutines() []GoroutineInfo {
+	tasks, err := store.Tasks(activeStates...)
+	if err != nil {
+		log.Printf("list tasks failed: %v", err)
+	}
+	return tasks
 }
 
 func main() {
@@ -1072,20 +1074,108 @@ func main() {
 	// 	UserName:   "莫昌康",
 	// 	Password:   "09010013",
 	// 	SportDate:  "2024-09-17",
-	// 	FirstTime:  "20:00",
-	// 	SecondTime: "21:00",
 	// 	IfExecNow:  "1",
 	// }
 	// getTheToken(&user)
 	// startRub(&user)
-	goroutines = make(map[int]*GoroutineInfo)
+	goroutines = make(map[int]*taskHandle)
+
+	var opts cliOptions
+	flag.BoolVar(&opts.ExecNow, "d", false, "直接运行, 不等待每天的抢票时间")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "演练: 登录并选好场地, 只打印要提交的表单, 不提交预约")
+	flag.StringVar(&opts.UserId, "u", "", "保存的用户的学号, 指定后在终端抢票而不启动网页")
+	flag.StringVar(&opts.SportDate, "date", "", "预约日期, 例如 2023-09-17")
+	flag.StringVar(&opts.Slots, "slots", "20:00-21:00,21:00-22:00", "要预约的时间段, 逗号分隔, 用 | 跟上按顺序的备选, 例如 \"20:00|21:00|19:00,21:00+1h\"")
+	flag.StringVar(&opts.Policy, "policy", "all", "完成条件: all 全部时间段, any 任意一个, 数字 N 至少 N 个")
+	flag.StringVar(&opts.FirstTime, "first", "20:00", "已废弃, 使用 -slots: 第一个场次时间")
+	flag.StringVar(&opts.SecondTime, "second", "21:00", "已废弃, 使用 -slots: 第二个场次时间")
+	flag.BoolVar(&opts.FirstOnly, "f", false, "已废弃, 使用 -slots: 只抢第一个场次")
+	flag.BoolVar(&opts.SecondOnly, "s", false, "已废弃, 使用 -slots: 只抢第二个场次")
+	userCmd := flag.String("user", "", "管理保存的用户: list, add, edit, delete, verify 或 import (导入旧版本的 users 或 users.bak, 用 -u 指定学号, 新增和修改时从标准输入读取密码)")
+	flag.StringVar(&opts.UserName, "name", "", "-user add/edit 时的姓名")
+	flag.StringVar(&opts.PhoneNumber, "phone", "", "-user add/edit 时的 11 位手机号")
+	catalogCmd := flag.String("catalog", "", "场地列表: list 列出缓存的场地 (有 -u 时先从服务器刷新), diff 对比服务器和 badmiton.json")
+	flag.StringVar(&opts.Venue, "venue", "", "场馆编码 CGBM 或名字, 默认 "+ehall.DefaultVenue)
+	flag.StringVar(&opts.Sport, "sport", "", "项目代码 XMDM 或名字, 默认 "+ehall.DefaultSport+" (羽毛球)")
+	flag.StringVar(&opts.Campus, "campus", "", "校区代码 XQDM 或名字, 默认 "+ehall.DefaultCampus)
+	flag.StringVar(&opts.CourtsRanked, "courts", "", "优先尝试的场地, 逗号分隔, 可以用通配符, 例如 羽毛球场B*")
+	flag.StringVar(&opts.CourtsInclude, "include", "", "只尝试这些场地, 逗号分隔")
+	flag.StringVar(&opts.CourtsExclude, "exclude", "", "不尝试这些场地, 逗号分隔")
+	flag.StringVar(&opts.ReleaseTime, "release", "", "每天放票时间, 例如 12:30:00, 默认使用配置文件")
+	flag.StringVar(&opts.LoginLead, "lead", "", "提前多久登录, 例如 4s, 默认使用配置文件")
+	flag.StringVar(&opts.RetryInterval, "retry", "", "重试间隔, 例如 3s, 默认使用配置文件")
+	configPath := flag.String("config", "config.json", "配置文件")
+	recordFile := flag.String("record", "", "把请求和响应记录到这个 JSONL 文件, 默认使用配置文件")
+	replayFile := flag.String("replay", "", "从记录文件回放响应, 不访问网络")
+	flag.Parse()
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	slots, legacy, err := legacySlots(opts, set)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	if legacy {
+		fmt.Fprintf(os.Stderr, "-first、-second、-f 和 -s 已废弃, 请改用 -slots %s\n", slots)
+		opts.Slots = slots
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config = cfg
+
+	if *recordFile == "" {
+		*recordFile = config.RecordFile
+	}
+	closeTraffic, err := setupTraffic(*recordFile, *replayFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 打开数据库, 旧版本的用户文件在升级时导入
+	store, err = openStore(config.DBFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *userCmd != "" {
+		code := runUserCLI(*userCmd, opts, os.Stdin)
+		closeTraffic()
+		flushStore()
+		os.Exit(code)
+	}
+	if *catalogCmd != "" {
+		code := runCatalogCLI(*catalogCmd, opts)
+		closeTraffic()
+		flushStore()
+		os.Exit(code)
+	}
+	if opts.UserId != "" {
+		code := runCLI(opts)
+		closeTraffic()
+		flushStore()
+		os.Exit(code)
+	}
+	if opts.ExecNow {
+		fmt.Fprintln(os.Stderr, "-d 需要和 -u 一起使用")
+		os.Exit(exitUsage)
+	}
 
 	server := http.Server{
 		Addr: "127.0.0.1:8080",
 	}
+	// 重新安排上次退出时还没有到抢票时间的任务
+	if err := resumeTasks(); err != nil {
+		log.Fatal(err)
+	}
+
 	http.HandleFunc("/", process)
 	http.HandleFunc("/add", add)
 	http.HandleFunc("/stop", stop)
+	http.HandleFunc("/courts", courts)
+	http.HandleFunc("/tasks", tasks)
 
 	log.Println("Listen at http://127.0.0.1:8080")
 	server.ListenAndServe()
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"RubCourse/ehall"
+	"RubCourse/szutest"
+)
+
+const (
+	testUserId   = "2300271032"
+	testPassword = "p@ssw0rd"
+	testDate     = "2099-09-17"
+	// badmiton.json 中的前两个场地
+	courtD6 = "15093a7663fa498695608f3d52cca59d"
+	courtC6 = "5bf45a019b8d40aaafbda985beb63dde"
+)
+
+func TestMain(m *testing.M) {
+	goroutines = make(map[int]*taskHandle)
+	os.Setenv(masterKeyEnv, "test master key")
+	os.Exit(m.Run())
+}
+
+// newFakeSZU 启动假的 authserver 和 ehall, 并让 casClient 和会话都指向它
+func newFakeSZU(t *testing.T) *szutest.Server {
+	t.Helper()
+	srv := szutest.NewServer()
+	t.Cleanup(srv.Close)
+
+	srv.AddUser(testUserId, testPassword)
+	srv.AddCourts(
+		szutest.Court{WID: courtD6, Name: "羽毛球场D6"},
+		szutest.Court{WID: courtC6, Name: "羽毛球场C6"},
+	)
+
+	oldClient, oldConfig, oldSessions, oldAvailabilities, oldCatalog, oldStore, oldLegacy, oldBackup := casClient, config, sessions, availabilities, catalog, store, legacyUsersFile, legacyUsersBackup
+	t.Cleanup(func() {
+		casClient, config, sessions, availabilities, catalog, store, legacyUsersFile, legacyUsersBackup = oldClient, oldConfig, oldSessions, oldAvailabilities, oldCatalog, oldStore, oldLegacy, oldBackup
+	})
+	casClient = srv.CASClient()
+	config = defaultConfig
+	config.ClockSync = false
+	// 同时提交的场地可能都预约成功, 大多数测试每个时间段只提交一个场地, 测试同时提交的自己设置
+	config.CourtAttempts = 1
+	config.CourtsURL = srv.CourtsURL()
+	config.SessionDir = t.TempDir()
+	config.CatalogFile = filepath.Join(t.TempDir(), "catalog.json")
+	config.CredentialFile = filepath.Join(t.TempDir(), "credentials.json")
+	config.DBFile = filepath.Join(t.TempDir(), "rub.db")
+	legacyUsersFile = filepath.Join(t.TempDir(), "users")
+	legacyUsersBackup = filepath.Join(t.TempDir(), "users.bak")
+	s, err := openStore(config.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	// 删除临时目录前写入排队的记录
+	t.Cleanup(func() { s.Flush() })
+	sessions = &sessionStore{users: make(map[string]*userSession)}
+	availabilities = newAvailabilityCache()
+	catalog = &catalogCache{entries: make(map[string]*catalogEntry)}
+	return srv
+}
+
+// testUser 返回直接运行的任务, slots 是逗号分隔的时间段, 全部预约成功才算完成
+func testUser(slots string) *UserInfo {
+	timeSlots, err := parseSlotChoices(slots)
+	if err != nil {
+		panic(err)
+	}
+	return &UserInfo{
+		UserId:    testUserId,
+		UserName:  "测试",
+		Password:  testPassword,
+		SportDate: testDate,
+		Slots:     timeSlots,
+		IfExecNow: "1",
+		Schedule:  Schedule{ReleaseTime: "12:30:00", LoginLead: 4 * time.Second, RetryInterval: 10 * time.Millisecond},
+	}
+}
+
+// runTask 像 process 一样注册并运行任务, 返回数据库中任务结束时的状态
+func runTask(t *testing.T, ctx context.Context, user *UserInfo) (GoroutineInfo, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	id, err := registerGoroutine(user, cancel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = startRub(ctx, user, id)
+	unregisterGoroutine(id, err)
+	info, taskErr := store.Task(id)
+	if taskErr != nil {
+		t.Fatal(taskErr)
+	}
+	return info, err
+}
+
+func TestStartRubBooksBothSlots(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00", courtC6)
+	srv.OpenSlot(testDate, "21:00", "22:00")
+
+	info, err := runTask(t, context.Background(), testUser("20:00-21:00,21:00-22:00"))
+	if err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	for _, v := range info.Slots {
+		if !v.Booked {
+			t.Errorf("slot %s not booked: %q", v.Slot, v.Error)
+		}
+	}
+
+	bookings := srv.Bookings()
+	if len(bookings) != 2 {
+		t.Fatalf("got %d bookings, want 2: %+v", len(bookings), bookings)
+	}
+	// 21:00 两个场地都空闲, 同时提交时哪个先成功都可以
+	want := map[string][]string{"20:00-21:00": {courtC6}, "21:00-22:00": {courtD6, courtC6}}
+	for _, b := range bookings {
+		ok := false
+		for _, id := range want[b.KYYSJD] {
+			ok = ok || id == b.CDWID
+		}
+		if b.UserId != testUserId || b.Date != testDate || !ok {
+			t.Errorf("unexpected booking %+v", b)
+		}
+		delete(want, b.KYYSJD)
+	}
+}
+
+func TestStartRubRetriesUntilSlotOpens(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.Inject("/getTimeList.do", 2, szutest.Fault{Status: 500, Body: "busy"})
+	srv.Inject("/insertVenueBookingInfo.do", 1, szutest.Fault{Drop: true})
+	srv.OpenSlot(testDate, "20:00", "21:00", courtD6)
+
+	if _, err := runTask(t, context.Background(), testUser("20:00-21:00")); err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	if n := len(srv.Bookings()); n != 1 {
+		t.Fatalf("got %d bookings, want 1", n)
+	}
+	if n := srv.Calls("/insertVenueBookingInfo.do"); n != 2 {
+		t.Errorf("insert called %d times, want 2", n)
+	}
+}
+
+func TestStartRubLogsInAgainWhenSessionExpires(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00")
+	srv.Inject("/getTimeList.do", 1, szutest.Fault{ExpireSessions: true})
+
+	info, err := runTask(t, context.Background(), testUser("20:00-21:00"))
+	if err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	if info.Relogins != 1 {
+		t.Errorf("Relogins = %d, want 1", info.Relogins)
+	}
+	if n := len(srv.Bookings()); n != 1 {
+		t.Errorf("got %d bookings, want 1", n)
+	}
+}
+
+func TestStartRubDoesNotLoginRepeatedlyOnMaintenancePage(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00")
+	// 维护页面不是 JSON, 会被当成登录失效
+	srv.Inject("/getTimeList.do", 1000, szutest.Fault{Status: 200, Body: "<html>系统维护中</html>"})
+
+	user := testUser("20:00-21:00")
+	user.Schedule.RetryInterval = 100 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := runTask(t, ctx, user); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// 每个重试间隔最多登录一次
+	if n := srv.Calls("/authserver/login"); n > 20 {
+		t.Errorf("authserver login called %d times in 500ms", n)
+	}
+}
+
+func TestStartRubWrongPassword(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00")
+	user := testUser("20:00-21:00")
+	user.Password = "wrong"
+
+	_, err := runTask(t, context.Background(), user)
+	if !errors.Is(err, errLoginFailed) {
+		t.Fatalf("err = %v, want %v", err, errLoginFailed)
+	}
+	if n := srv.Calls("/insertVenueBookingInfo.do"); n != 0 {
+		t.Errorf("insert called %d times after failed login", n)
+	}
+}
+
+func TestStartRubCancelWhileWaiting(t *testing.T) {
+	newFakeSZU(t)
+	user := testUser("20:00-21:00")
+	user.IfExecNow = ""
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	info, err := runTask(t, ctx, user)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("cancel took %v", time.Since(start))
+	}
+	if info.NextFire == "" {
+		t.Error("NextFire not set")
+	}
+}
+
+func TestStartRubCancelWhilePolling(t *testing.T) {
+	srv := newFakeSZU(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	info, err := runTask(t, ctx, testUser("20:00-21:00,21:00-22:00"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	for _, v := range info.Slots {
+		if v.Error == "" {
+			t.Errorf("slot %s: want slot gone recorded", v.Slot)
+		}
+	}
+	if n := len(srv.Bookings()); n != 0 {
+		t.Errorf("got %d bookings, want 0", n)
+	}
+}
+
+func TestStartRubDryRunDoesNotInsert(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00", courtC6)
+	user := testUser("20:00-21:00")
+	user.DryRun = true
+
+	if _, err := runTask(t, context.Background(), user); err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	if n := srv.Calls("/insertVenueBookingInfo.do"); n != 0 {
+		t.Errorf("insert called %d times in dry run", n)
+	}
+	if n := srv.Calls("/getOpeningRoom.do"); n == 0 {
+		t.Error("dry run did not query getOpeningRoom.do")
+	}
+}
+
+func TestStartRubInsertsInParallel(t *testing.T) {
+	srv := newFakeSZU(t)
+	config.CourtAttempts = 3
+	srv.OpenSlot(testDate, "20:00", "21:00")
+	// 第一个提交的请求一直没有响应, 其他场地成功后应该被取消
+	srv.Inject("/insertVenueBookingInfo.do", 1, szutest.Fault{Delay: 5 * time.Second})
+
+	start := time.Now()
+	info, err := runTask(t, context.Background(), testUser("20:00-21:00"))
+	if err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("booking took %v, slow request was not cancelled", d)
+	}
+	if n := len(srv.Bookings()); n != 1 {
+		t.Errorf("got %d bookings, want 1", n)
+	}
+	if bookings, err := store.Bookings(); err != nil || len(bookings) != 1 {
+		t.Errorf("recorded bookings = %+v, %v, want 1", bookings, err)
+	}
+	if s := info.Slots[0]; len(s.Courts) != 1 || s.Duplicates() != 0 {
+		t.Errorf("slot status = %+v, want one court", s)
+	}
+	if n := srv.Calls("/getTimeList.do"); n != 1 {
+		t.Errorf("getTimeList.do called %d times, want 1", n)
+	}
+	if n := srv.Calls("/getOpeningRoom.do"); n != 1 {
+		t.Errorf("getOpeningRoom.do called %d times, want 1", n)
+	}
+}
+
+func TestStartRubCancelWhileInserting(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00")
+	srv.Inject("/insertVenueBookingInfo.do", 1, szutest.Fault{Delay: 5 * time.Second})
+
+	// 停止任务时正在进行的预约请求立即中断
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := runTask(t, ctx, testUser("20:00-21:00")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cancel took %v", d)
+	}
+	if n := len(srv.Bookings()); n != 0 {
+		t.Errorf("got %d bookings, want 0", n)
+	}
+}
+
+func TestStartRubReusesAvailabilitySnapshot(t *testing.T) {
+	srv := newFakeSZU(t)
+	config.CourtAttempts = 1
+	srv.OpenSlot(testDate, "20:00", "21:00")
+	srv.Inject("/insertVenueBookingInfo.do", 1, szutest.Fault{Body: `{"code":"1","msg":"该场地已被预约","success":false}`})
+
+	if _, err := runTask(t, context.Background(), testUser("20:00-21:00")); err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	bookings := srv.Bookings()
+	if len(bookings) != 1 || bookings[0].CDWID != courtC6 {
+		t.Fatalf("bookings = %+v, want %s after %s was rejected", bookings, courtC6, courtD6)
+	}
+	if n := srv.Calls("/getOpeningRoom.do"); n != 1 {
+		t.Errorf("getOpeningRoom.do called %d times, want 1", n)
+	}
+}
+
+func TestStartRubRefreshesSnapshotWithoutFreeCourts(t *testing.T) {
+	srv := newFakeSZU(t)
+	config.AvailabilityRefresh = "1h"
+	srv.OpenSlot(testDate, "20:00", "21:00", courtD6)
+	srv.Inject("/insertVenueBookingInfo.do", 1, szutest.Fault{Body: `{"code":"1","msg":"该场地已被预约","success":false}`})
+
+	if _, err := runTask(t, context.Background(), testUser("20:00-21:00")); err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	if n := srv.Calls("/getOpeningRoom.do"); n != 2 {
+		t.Errorf("getOpeningRoom.do called %d times, want 2", n)
+	}
+}
+
+func TestStartRubFollowsCourtPreference(t *testing.T) {
+	srv := newFakeSZU(t)
+	config.CourtAttempts = 1
+	srv.OpenSlot(testDate, "20:00", "21:00")
+	user := testUser("20:00-21:00")
+	user.Courts = CourtPreference{Exclude: []string{"羽毛球场C6"}}
+	user.TaskCourts = CourtPreference{Ranked: []string{"羽毛球场C*", "羽毛球场D*"}}
+
+	// 任务的优先列表先选 C6, 但用户排除了 C6
+	if _, err := runTask(t, context.Background(), user); err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	bookings := srv.Bookings()
+	if len(bookings) != 1 || bookings[0].CDWID != courtD6 {
+		t.Errorf("bookings = %+v, want %s", bookings, courtD6)
+	}
+}
+
+func TestStartRubBooksOtherSportAndCampus(t *testing.T) {
+	srv := newFakeSZU(t)
+	tennis := ehall.Place{Venue: "002", Sport: "003", Campus: "2"}
+	srv.AddCourts(szutest.Court{WID: "tennis-1", Name: "网球场1", Place: tennis})
+	srv.OpenSlot(testDate, "19:00", "20:00")
+
+	// 先用代码预约一次, 记下场馆、项目和校区的名字
+	user := testUser("19:00-20:00")
+	user.Place = tennis
+	if _, err := runTask(t, context.Background(), user); err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	bookings := srv.Bookings()
+	if len(bookings) != 1 || bookings[0].CDWID != "tennis-1" || bookings[0].Place != tennis {
+		t.Fatalf("bookings = %+v, want tennis-1 at %+v", bookings, tennis)
+	}
+
+	place, err := resolvePlace("北区体育馆", "网球", "丽湖校区")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if place != tennis {
+		t.Errorf("resolvePlace = %+v, want %+v", place, tennis)
+	}
+	if _, err := resolvePlace("", "篮球", ""); err == nil {
+		t.Error("resolvePlace accepted an unknown sport name")
+	}
+}
+
+func TestStartRubUsesSnapshotCourtsWithoutCatalog(t *testing.T) {
+	srv := newFakeSZU(t)
+	tennis := ehall.Place{Venue: "002", Sport: "003", Campus: "2"}
+	srv.AddCourts(szutest.Court{WID: "tennis-1", Name: "网球场1", Place: tennis})
+	srv.OpenSlot(testDate, "19:00", "20:00")
+	// 获取不到场地列表, badmiton.json 也只有默认的羽毛球场
+	srv.Inject("/getCdxx.do", 100, szutest.Fault{Status: 500})
+
+	user := testUser("19:00-20:00")
+	user.Place = tennis
+	if _, err := runTask(t, context.Background(), user); err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	bookings := srv.Bookings()
+	if len(bookings) != 1 || bookings[0].CDWID != "tennis-1" || bookings[0].Place != tennis {
+		t.Errorf("bookings = %+v, want tennis-1 at %+v", bookings, tennis)
+	}
+	if n := srv.Calls("/getCdxx.do"); n == 0 {
+		t.Error("court list was not requested")
+	}
+}
+
+func TestStartRubBooksLongSlot(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "19:00", "21:00", courtC6)
+
+	if _, err := runTask(t, context.Background(), testUser("19:00+2h")); err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	bookings := srv.Bookings()
+	if len(bookings) != 1 || bookings[0].KYYSJD != "19:00-21:00" || bookings[0].CDWID != courtC6 {
+		t.Fatalf("bookings = %+v, want %s at 19:00-21:00", bookings, courtC6)
+	}
+}
+
+func TestStartRubCompletionPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   int
+	}{
+		{"any", 1},
+		{"2", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			srv := newFakeSZU(t)
+			// 只有两个时间段会开放, 第三个一直约不到
+			srv.OpenSlot(testDate, "19:00", "20:00", courtD6)
+			srv.OpenSlot(testDate, "20:00", "21:00", courtD6)
+
+			user := testUser("19:00,20:00,21:00")
+			user.Policy, _ = parseCompletionPolicy(tt.policy, len(user.Slots))
+			info, err := runTask(t, context.Background(), user)
+			if err != nil {
+				t.Fatalf("startRub: %v", err)
+			}
+			booked := 0
+			for _, v := range info.Slots {
+				if v.Booked {
+					booked++
+				}
+			}
+			// 满足条件时已经发出的请求也会完成, 服务器上的每个预约都要记下来
+			if booked < tt.want || len(srv.Bookings()) != booked {
+				t.Errorf("booked %d slots (%d on server), want at least %d", booked, len(srv.Bookings()), tt.want)
+			}
+			if recorded, err := store.Bookings(); err != nil || len(recorded) != len(srv.Bookings()) {
+				t.Errorf("recorded %d bookings, %v, want %d", len(recorded), err, len(srv.Bookings()))
+			}
+			if info.Slots[2].Booked {
+				t.Error("21:00 booked but never opened")
+			}
+		})
+	}
+}
+
+func TestStartRubRecordsInsertFinishedAfterPolicyMet(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "19:00", "20:00", courtD6)
+	srv.OpenSlot(testDate, "20:00", "21:00", courtD6)
+	// 一个时间段的请求很慢, 另一个成功后满足完成条件, 慢的请求在服务器上也成功了
+	srv.Inject("/insertVenueBookingInfo.do", 1, szutest.Fault{Delay: 300 * time.Millisecond})
+
+	user := testUser("19:00,20:00")
+	user.Policy, _ = parseCompletionPolicy("any", len(user.Slots))
+	info, err := runTask(t, context.Background(), user)
+	if err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	if n := len(srv.Bookings()); n != 2 {
+		t.Fatalf("got %d bookings on server, want 2", n)
+	}
+	for _, v := range info.Slots {
+		if !v.Booked {
+			t.Errorf("slot %s booked on server but not recorded: %+v", v.Slot, v)
+		}
+	}
+	if recorded, err := store.Bookings(); err != nil || len(recorded) != 2 {
+		t.Errorf("recorded bookings = %+v, %v, want 2", recorded, err)
+	}
+}
+
+func TestStartRubFallsBackToAlternative(t *testing.T) {
+	srv := newFakeSZU(t)
+	// 20:00 没有开放, 21:00 开放
+	srv.OpenSlot(testDate, "21:00", "22:00", courtC6)
+	srv.OpenSlot(testDate, "19:00", "20:00", courtC6)
+
+	info, err := runTask(t, context.Background(), testUser("20:00|21:00|19:00"))
+	if err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	bookings := srv.Bookings()
+	if len(bookings) != 1 || bookings[0].KYYSJD != "21:00-22:00" {
+		t.Fatalf("bookings = %+v, want 21:00-22:00", bookings)
+	}
+	if s := info.Slots[0]; !s.Booked || !s.Fallback || s.BookedSlot != "21:00-22:00" {
+		t.Errorf("slot status = %+v, want fallback 21:00-22:00", s)
+	}
+}
+
+func TestStartRubAlternativesDoNotDoubleBook(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "21:00", "22:00")
+	srv.OpenSlot(testDate, "19:00", "20:00")
+
+	// 两个时间段的首选都约不到, 相同的备选只能给其中一个
+	if _, err := runTask(t, context.Background(), testUser("20:00|21:00|19:00,18:00|21:00|19:00")); err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	got := map[string]bool{}
+	for _, b := range srv.Bookings() {
+		got[b.KYYSJD] = true
+	}
+	if len(srv.Bookings()) != 2 || !got["21:00-22:00"] || !got["19:00-20:00"] {
+		t.Errorf("bookings = %+v, want 21:00-22:00 and 19:00-20:00", srv.Bookings())
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"RubCourse/ehall"
+)
+
+// knownPlace 是 getOpeningRoom.do 返回过的场馆、项目和校区, 名字来自 *_DISPLAY 字段
+type knownPlace struct {
+	ehall.Place
+	VenueName  string
+	SportName  string
+	CampusName string
+}
+
+func (p knownPlace) String() string {
+	return fmt.Sprintf("%s %s %s", p.CampusName, p.VenueName, p.SportName)
+}
+
+// placeOf 返回场地行中的场馆、项目和校区
+func placeOf(row ehall.OpenRoomData) knownPlace {
+	return knownPlace{
+		Place:      row.Place(),
+		VenueName:  row.CGBM_DISPLAY,
+		SportName:  row.XMDM_DISPLAY,
+		CampusName: row.XQDM_DISPLAY,
+	}
+}
+
+// resolvePlace 把任务填写的场馆、项目和校区转换成代码. 每一项可以填代码,
+// 也可以填见过的显示名字 (例如 羽毛球, 粤海校区), 为空时使用默认值
+func resolvePlace(venue, sport, campus string) (ehall.Place, error) {
+	known := catalog.Places()
+	var err error
+	place := ehall.Place{}
+	if place.Venue, err = resolvePlaceField("场馆", venue, known, func(p knownPlace) (string, string) { return p.Venue, p.VenueName }); err != nil {
+		return place, err
+	}
+	if place.Sport, err = resolvePlaceField("项目", sport, known, func(p knownPlace) (string, string) { return p.Sport, p.SportName }); err != nil {
+		return place, err
+	}
+	if place.Campus, err = resolvePlaceField("校区", campus, known, func(p knownPlace) (string, string) { return p.Campus, p.CampusName }); err != nil {
+		return place, err
+	}
+	return place.WithDefaults(), nil
+}
+
+func resolvePlaceField(kind, value string, known []knownPlace, field func(knownPlace) (code, name string)) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	for _, p := range known {
+		if code, name := field(p); value == code || value == name {
+			return code, nil
+		}
+	}
+	// 代码都是字母和数字, 没见过的名字没法转换
+	for _, r := range value {
+		if r > 127 {
+			return "", fmt.Errorf("未知的%s %q, 请填写代码或先查询一次该项目的场地", kind, value)
+		}
+	}
+	return value, nil
+}
+
+// placeLabel 在页面和日志中显示任务的场馆、项目和校区, 见过的用名字显示
+func placeLabel(place ehall.Place) string {
+	place = place.WithDefaults()
+	for _, p := range catalog.Places() {
+		if p.Place == place {
+			return p.String()
+		}
+	}
+	return fmt.Sprintf("校区 %s 场馆 %s 项目 %s", place.Campus, place.Venue, place.Sport)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 主密钥的环境变量, 没有设置时使用 config.KeyFile
+const masterKeyEnv = "RUB_MASTER_KEY"
+
+var (
+	masterKeyOnce  sync.Once
+	masterKeyBytes []byte
+	masterKeyErr   error
+)
+
+// masterKey 返回用于加密本地数据的 AES-256 密钥.
+// 优先读取环境变量 RUB_MASTER_KEY, 其次读取密钥文件, 都没有时生成新的密钥文件.
+func masterKey() ([]byte, error) {
+	masterKeyOnce.Do(func() {
+		masterKeyBytes, masterKeyErr = loadMasterKey(config.KeyFile)
+	})
+	return masterKeyBytes, masterKeyErr
+}
+
+func loadMasterKey(keyFile string) ([]byte, error) {
+	if v := os.Getenv(masterKeyEnv); v != "" {
+		key := sha256.Sum256([]byte(v))
+		return key[:], nil
+	}
+
+	data, err := ioutil.ReadFile(keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		random := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, random); err != nil {
+			return nil, err
+		}
+		data = []byte(base64.StdEncoding.EncodeToString(random))
+		// O_EXCL 防止覆盖别的进程刚生成的密钥
+		f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("create key file: %w", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("write key file: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+
+	content := strings.TrimSpace(string(data))
+	if content == "" {
+		return nil, fmt.Errorf("key file %s is empty", keyFile)
+	}
+	key := sha256.Sum256([]byte(content))
+	return key[:], nil
+}
+
+// encryptSecret 用主密钥加密, 结果为 nonce + AES-GCM 密文
+func encryptSecret(plaintext []byte) ([]byte, error) {
+	gcm, err := masterGCM()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decryptSecret 解密 encryptSecret 的结果
+func decryptSecret(ciphertext []byte) ([]byte, error) {
+	gcm, err := masterGCM()
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w (wrong master key?)", err)
+	}
+	return plaintext, nil
+}
+
+func masterGCM() (cipher.AEAD, error) {
+	key, err := masterKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"RubCourse/ehall"
+)
+
+// savedSession 是加密保存在 config.SessionDir 中的会话
+type savedSession struct {
+	UserId     string
+	Cookies    []ehall.SavedCookie
+	LoggedInAt time.Time
+	// 估计的失效时间, 之后不再复用
+	ExpiresAt time.Time
+}
+
+// userSession 是一个学号的会话, 同一个学号的任务共用
+type userSession struct {
+	mu        sync.Mutex
+	session   *ehall.Session
+	expiresAt time.Time
+}
+
+// sessionStore 管理所有学号的会话, 同一个学号同时只会登录一次
+type sessionStore struct {
+	mu    sync.Mutex
+	users map[string]*userSession
+}
+
+var sessions = &sessionStore{users: make(map[string]*userSession)}
+
+func (s *sessionStore) user(userId string) *userSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	us, ok := s.users[userId]
+	if !ok {
+		us = &userSession{}
+		s.users[userId] = us
+	}
+	return us
+}
+
+// Get 返回用户可用的会话: 先用内存中的, 再用磁盘上保存的, 都失效时重新登录
+func (s *sessionStore) Get(ctx context.Context, user *UserInfo) (*ehall.Session, error) {
+	us := s.user(user.UserId)
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if us.session == nil {
+		saved, err := loadSession(user.UserId)
+		if err != nil {
+			log.Printf("load saved session for %s failed: %v", user.UserId, err)
+		} else if saved != nil {
+			us.session = ehall.RestoreSession(saved.Cookies)
+			us.expiresAt = saved.ExpiresAt
+		}
+	}
+
+	if us.session != nil && time.Now().Before(us.expiresAt) {
+		ok, err := newEhallClient(us.session).CheckSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			fmt.Println("复用已登录的会话:", user.UserName)
+			return us.session, nil
+		}
+		fmt.Println("会话已失效, 重新登录:", user.UserName)
+	}
+
+	session, err := casClient.Login(ctx, user.UserId, user.Password)
+	if err != nil {
+		return nil, err
+	}
+	us.session = session
+	us.expiresAt = time.Now().Add(config.sessionTTL())
+
+	if err := saveSession(user.UserId, session, us.expiresAt); err != nil {
+		log.Printf("save session for %s failed: %v", user.UserId, err)
+	}
+	return session, nil
+}
+
+// Current 返回用户当前的会话, 正在登录时等待登录完成
+func (s *sessionStore) Current(userId string) *ehall.Session {
+	us := s.user(userId)
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.session
+}
+
+// Invalidate 丢弃用户的会话, 如果它还是 session 的话.
+// 已经被别的任务换成新会话时返回 false
+func (s *sessionStore) Invalidate(userId string, session *ehall.Session) bool {
+	us := s.user(userId)
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.session != session {
+		return false
+	}
+	us.session = nil
+	os.Remove(sessionPath(userId))
+	return true
+}
+
+func sessionPath(userId string) string {
+	return filepath.Join(config.SessionDir, filepath.Base(userId)+".session")
+}
+
+func saveSession(userId string, session *ehall.Session, expiresAt time.Time) error {
+	data, err := json.Marshal(savedSession{
+		UserId:     userId,
+		Cookies:    session.Export(casClient.LoginURL, casClient.EhallURL),
+		LoggedInAt: time.Now(),
+		ExpiresAt:  expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	encrypted, err := encryptSecret(data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.SessionDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(sessionPath(userId), encrypted, 0600)
+}
+
+// loadSession 读取保存的会话, 没有或已过期时返回 nil
+func loadSession(userId string) (*savedSession, error) {
+	encrypted, err := ioutil.ReadFile(sessionPath(userId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := decryptSecret(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	var saved savedSession
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	if saved.UserId != userId || time.Now().After(saved.ExpiresAt) {
+		return nil, nil
+	}
+	return &saved, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestSessionsLogInOncePerUser(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00")
+	srv.OpenSlot(testDate, "21:00", "22:00")
+
+	// 同一个学号的两个任务同时开始, 只登录一次
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, slots := range []string{"20:00-21:00", "21:00-22:00"} {
+		wg.Add(1)
+		go func(i int, slots string) {
+			defer wg.Done()
+			_, errs[i] = runTask(t, context.Background(), testUser(slots))
+		}(i, slots)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("startRub: %v", err)
+		}
+	}
+	if n := srv.Logins(); n != 1 {
+		t.Errorf("logged in %d times, want 1", n)
+	}
+}
+
+func TestSessionsRestoreSavedSession(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00")
+	srv.OpenSlot(testDate, "21:00", "22:00")
+
+	if _, err := runTask(t, context.Background(), testUser("20:00-21:00")); err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	if _, err := os.Stat(sessionPath(testUserId)); err != nil {
+		t.Fatalf("session not saved: %v", err)
+	}
+
+	// 像重启程序一样清空内存中的会话
+	sessions = &sessionStore{users: make(map[string]*userSession)}
+	probes := srv.Calls("/getOrderNum.do")
+	if _, err := runTask(t, context.Background(), testUser("21:00-22:00")); err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	if n := srv.Logins(); n != 1 {
+		t.Errorf("logged in %d times, want 1", n)
+	}
+	// 检查保存的会话一次, 取订单号一次
+	if n := srv.Calls("/getOrderNum.do") - probes; n != 2 {
+		t.Errorf("getOrderNum.do called %d times, want a probe and the order number", n)
+	}
+	if n := len(srv.Bookings()); n != 2 {
+		t.Errorf("got %d bookings, want 2", n)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"RubCourse/ehall"
+)
+
+// 只写开始时间时的时长
+const defaultSlotDuration = time.Hour
+
+// TimeSlot 是任务要预约的一个时间段, Start/End 格式为 15:04
+type TimeSlot struct {
+	Start string
+	End   string
+}
+
+func (s TimeSlot) String() string {
+	return s.Start + "-" + s.End
+}
+
+// Duration 返回时间段的时长
+func (s TimeSlot) Duration() time.Duration {
+	start, _ := time.Parse("15:04", s.Start)
+	end, _ := time.Parse("15:04", s.End)
+	return end.Sub(start)
+}
+
+// On 返回某天的这个时间段
+func (s TimeSlot) On(date string) ehall.Slot {
+	return ehall.Slot{Date: date, Start: s.Start, End: s.End}
+}
+
+// parseTimeSlot 解析一个时间段, 可以是 19:00-21:00, 19:00+2h 或者 19:00 (一个小时)
+func parseTimeSlot(s string) (TimeSlot, error) {
+	s = strings.TrimSpace(s)
+	startText, duration := s, defaultSlotDuration
+	endText, hasEnd := "", false
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		startText = strings.TrimSpace(s[:i])
+		rest := strings.TrimSpace(s[i+1:])
+		if s[i] == '-' {
+			endText, hasEnd = rest, true
+		} else {
+			d, err := time.ParseDuration(rest)
+			if err != nil {
+				return TimeSlot{}, fmt.Errorf("时间段 %q 的时长格式错误: %v", s, err)
+			}
+			duration = d
+		}
+	}
+
+	start, err := time.Parse("15:04", startText)
+	if err != nil {
+		return TimeSlot{}, fmt.Errorf("时间段 %q 的开始时间格式错误: %v", s, err)
+	}
+	end := start.Add(duration)
+	if hasEnd {
+		if end, err = time.Parse("15:04", endText); err != nil {
+			return TimeSlot{}, fmt.Errorf("时间段 %q 的结束时间格式错误: %v", s, err)
+		}
+	}
+	if !end.After(start) || end.Day() != start.Day() {
+		return TimeSlot{}, fmt.Errorf("时间段 %q 的结束时间需要在开始时间之后的当天", s)
+	}
+	return TimeSlot{Start: start.Format("15:04"), End: end.Format("15:04")}, nil
+}
+
+// SlotChoice 是任务要预约的一个时间段和按顺序的备选时间段, 第一个是首选
+type SlotChoice []TimeSlot
+
+func (c SlotChoice) String() string {
+	names := make([]string, len(c))
+	for i, v := range c {
+		names[i] = v.String()
+	}
+	return strings.Join(names, " | ")
+}
+
+// parseSlotChoices 解析逗号分隔的时间段, 每个时间段可以用 | 跟上备选, 例如 20:00|21:00|19:00,21:00-22:00.
+// 不能为空, 首选的时间段不能重复
+func parseSlotChoices(s string) ([]SlotChoice, error) {
+	var choices []SlotChoice
+	seen := make(map[TimeSlot]bool)
+	for _, v := range strings.Split(s, ",") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		var choice SlotChoice
+		for _, alt := range strings.Split(v, "|") {
+			slot, err := parseTimeSlot(alt)
+			if err != nil {
+				return nil, err
+			}
+			for _, prev := range choice {
+				if prev == slot {
+					return nil, fmt.Errorf("时间段 %s 的备选重复", choice[0])
+				}
+			}
+			choice = append(choice, slot)
+		}
+		if seen[choice[0]] {
+			return nil, fmt.Errorf("时间段 %s 重复", choice[0])
+		}
+		seen[choice[0]] = true
+		choices = append(choices, choice)
+	}
+	if len(choices) == 0 {
+		return nil, fmt.Errorf("没有要预约的时间段")
+	}
+	return choices, nil
+}
+
+// slotClaims 记录任务中正在预约或已经预约的时间段, 同一个任务中一个时间段只由一个协程预约,
+// 几个时间段的备选相同时不会重复预约
+type slotClaims struct {
+	mu    sync.Mutex
+	slots map[TimeSlot]bool
+}
+
+// claim 占用时间段, 已经被占用时返回 false
+func (c *slotClaims) claim(slot TimeSlot) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.slots == nil {
+		c.slots = make(map[TimeSlot]bool)
+	}
+	if c.slots[slot] {
+		return false
+	}
+	c.slots[slot] = true
+	return true
+}
+
+// release 预约失败时释放时间段
+func (c *slotClaims) release(slot TimeSlot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.slots, slot)
+}
+
+// slotsFromForm 读取网页表单中的时间段、备选和完成条件, 开始时间为空的行会跳过
+func slotsFromForm(r *http.Request) ([]SlotChoice, CompletionPolicy, error) {
+	r.ParseForm()
+	ends := r.Form["slotEnd"]
+	alternatives := r.Form["slotAlternatives"]
+	var specs []string
+	for i, start := range r.Form["slotStart"] {
+		if start == "" {
+			continue
+		}
+		spec := start
+		if i < len(ends) && ends[i] != "" {
+			spec += "-" + ends[i]
+		}
+		if i < len(alternatives) && strings.TrimSpace(alternatives[i]) != "" {
+			spec += "|" + alternatives[i]
+		}
+		specs = append(specs, spec)
+	}
+	slots, err := parseSlotChoices(strings.Join(specs, ","))
+	if err != nil {
+		return nil, CompletionPolicy{}, err
+	}
+	policy := r.FormValue("policy")
+	if policy == "atLeast" {
+		policy = r.FormValue("atLeast")
+	}
+	p, err := parseCompletionPolicy(policy, len(slots))
+	if err != nil {
+		return nil, CompletionPolicy{}, err
+	}
+	return slots, p, nil
+}
+
+// CompletionPolicy 决定预约成功多少个时间段算任务完成
+type CompletionPolicy struct {
+	// 至少预约成功的时间段数量, 0 表示全部
+	AtLeast int
+}
+
+// parseCompletionPolicy 解析完成条件: all (全部, 默认), any (任意一个) 或者数字 N (至少 N 个)
+func parseCompletionPolicy(s string, slots int) (CompletionPolicy, error) {
+	switch s = strings.TrimSpace(s); s {
+	case "", "all":
+		return CompletionPolicy{}, nil
+	case "any":
+		return CompletionPolicy{AtLeast: 1}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return CompletionPolicy{}, fmt.Errorf("完成条件 %q 格式错误, 可以是 all, any 或者数字", s)
+	}
+	if n < 1 || n > slots {
+		return CompletionPolicy{}, fmt.Errorf("完成条件至少 %d 个时间段, 需要在 1 到 %d 之间", n, slots)
+	}
+	return CompletionPolicy{AtLeast: n}, nil
+}
+
+// Need 返回 total 个时间段中需要预约成功的数量
+func (p CompletionPolicy) Need(total int) int {
+	if p.AtLeast == 0 || p.AtLeast > total {
+		return total
+	}
+	return p.AtLeast
+}
+
+func (p CompletionPolicy) String() string {
+	switch p.AtLeast {
+	case 0:
+		return "全部"
+	case 1:
+		return "任意一个"
+	}
+	return fmt.Sprintf("至少 %d 个", p.AtLeast)
+}
+
+// SlotStatus 是任务中一个时间段的状态
+type SlotStatus struct {
+	// 时间段和备选
+	Slot string
+	// 已经预约成功 (演练时是已经选好场地)
+	Booked bool
+	// 实际预约的时间段, 可能是备选
+	BookedSlot string
+	// 预约的是备选时间段
+	Fallback bool
+	// 预约到的场地, 同时提交的几个场地都成功时有多个
+	Courts []string
+	// 最近一次失败的原因
+	Error string
+}
+
+// Duplicates 是重复预约的场地数, 需要到 ehall 上手动取消
+func (s SlotStatus) Duplicates() int {
+	if len(s.Courts) < 2 {
+		return 0
+	}
+	return len(s.Courts) - 1
+}
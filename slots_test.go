@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSlotChoices(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []SlotChoice
+		err  bool
+	}{
+		{"20:00", []SlotChoice{{{"20:00", "21:00"}}}, false},
+		{"19:00-21:00, 21:00+30m", []SlotChoice{{{"19:00", "21:00"}}, {{"21:00", "21:30"}}}, false},
+		{"9:30+90m", []SlotChoice{{{"09:30", "11:00"}}}, false},
+		{"20:00|21:00|19:00,21:00", []SlotChoice{{{"20:00", "21:00"}, {"21:00", "22:00"}, {"19:00", "20:00"}}, {{"21:00", "22:00"}}}, false},
+		{"", nil, true},
+		{"21:00-20:00", nil, true},
+		{"23:00+2h", nil, true},
+		{"20:00,20:00-21:00", nil, true},
+		{"20:00-", nil, true},
+		{"20:00|20:00-21:00", nil, true},
+		{"20:00|", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSlotChoices(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("parseSlotChoices(%q) err = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSlotChoices(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	if d := (TimeSlot{"19:00", "21:00"}).Duration(); d != 2*time.Hour {
+		t.Errorf("Duration = %v, want 2h", d)
+	}
+}
+
+func TestParseCompletionPolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		need int
+		err  bool
+	}{
+		{"", 3, false},
+		{"all", 3, false},
+		{"any", 1, false},
+		{"2", 2, false},
+		{"0", 0, true},
+		{"4", 0, true},
+		{"most", 0, true},
+	}
+	for _, tt := range tests {
+		p, err := parseCompletionPolicy(tt.in, 3)
+		if (err != nil) != tt.err {
+			t.Errorf("parseCompletionPolicy(%q) err = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && p.Need(3) != tt.need {
+			t.Errorf("parseCompletionPolicy(%q).Need(3) = %d, want %d", tt.in, p.Need(3), tt.need)
+		}
+	}
+}
+
+func TestLegacySlots(t *testing.T) {
+	base := cliOptions{Slots: "20:00-21:00,21:00-22:00", FirstTime: "20:00", SecondTime: "21:00"}
+	tests := []struct {
+		name   string
+		set    []string
+		modify func(o *cliOptions)
+		want   string
+		legacy bool
+		err    bool
+	}{
+		{"none", nil, nil, base.Slots, false, false},
+		{"slots only", []string{"slots"}, func(o *cliOptions) { o.Slots = "19:00" }, "19:00", false, false},
+		{"first and second", []string{"first", "second"}, func(o *cliOptions) { o.FirstTime, o.SecondTime = "19:00", "20:00" }, "19:00,20:00", true, false},
+		{"first only", []string{"f"}, func(o *cliOptions) { o.FirstOnly = true }, "20:00", true, false},
+		{"second only", []string{"s", "second"}, func(o *cliOptions) { o.SecondOnly, o.SecondTime = true, "22:00" }, "22:00", true, false},
+		{"both", []string{"f", "s"}, func(o *cliOptions) { o.FirstOnly, o.SecondOnly = true, true }, "20:00,21:00", true, false},
+		{"with slots", []string{"f", "slots"}, func(o *cliOptions) { o.FirstOnly = true }, "", true, true},
+	}
+	for _, tt := range tests {
+		opts := base
+		if tt.modify != nil {
+			tt.modify(&opts)
+		}
+		set := make(map[string]bool)
+		for _, name := range tt.set {
+			set[name] = true
+		}
+		got, legacy, err := legacySlots(opts, set)
+		if (err != nil) != tt.err || got != tt.want || legacy != tt.legacy {
+			t.Errorf("%s: legacySlots = %q, %v, %v, want %q, %v, error %v", tt.name, got, legacy, err, tt.want, tt.legacy, tt.err)
+		}
+	}
+}
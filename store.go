@@ -0,0 +1,500 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 数据库中的 bucket
+var (
+	bucketMeta     = []byte("meta")
+	bucketUsers    = []byte("users")
+	bucketTasks    = []byte("tasks")
+	bucketAttempts = []byte("attempts")
+	bucketBookings = []byte("bookings")
+	// 还没有结束的任务的参数, 重启后用来恢复任务
+	bucketTaskParams = []byte("taskParams")
+
+	keySchemaVersion = []byte("schemaVersion")
+)
+
+var errTaskNotFound = errors.New("没有这个任务")
+
+// 等待其他进程读写数据库的最长时间
+const storeLockTimeout = 5 * time.Second
+
+// 排队的记录最多等这么久写入数据库, 见 queue
+const storeFlushDelay = 500 * time.Millisecond
+
+// Store 是保存用户、任务、尝试记录和预约记录的数据库, 所有页面和命令行都从这里读写.
+// bbolt 打开数据库时会锁住整个文件, 所以只在每次读写时打开, 网页运行时命令行也可以使用同一个数据库.
+// 抢票时的尝试、预约和任务状态先排队, 稍后一起写入, 抢票循环中不用打开数据库
+type Store struct {
+	path string
+	// 同一个进程内的读写在这里排队, 不用等待文件锁
+	mu sync.RWMutex
+
+	pendingMu sync.Mutex
+	// 还没有写入数据库的记录, 按顺序写入
+	pending    []func(tx *bolt.Tx) error
+	flushTimer *time.Timer
+}
+
+// store 在 main 中打开
+var store *Store
+
+// migration 是一个数据库版本的升级步骤, 按 version 顺序执行, 已经执行过的不再执行
+type migration struct {
+	version int
+	name    string
+	apply   func(tx *bolt.Tx) error
+}
+
+var migrations = []migration{
+	{1, "create buckets", func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketUsers, bucketTasks, bucketAttempts, bucketBookings} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{2, "import users from credentials file", func(tx *bolt.Tx) error {
+		if err := importUserFiles(tx); !errors.Is(err, errNoUserFile) {
+			return err
+		}
+		return nil
+	}},
+	{3, "create task params bucket", func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketTaskParams)
+		return err
+	}},
+}
+
+// openStore 创建或升级数据库到最新版本
+func openStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if err := s.migrate(); err != nil {
+		return nil, fmt.Errorf("migrate %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// open 打开数据库文件, 其他进程正在写时最多等待 storeLockTimeout
+func (s *Store) open(readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: storeLockTimeout, ReadOnly: readOnly})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("open %s: 数据库正在被其他进程使用", s.path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", s.path, err)
+	}
+	return db, nil
+}
+
+// view 打开数据库执行只读事务, 多个进程可以同时读. 有排队的记录时先写入, 读到的数据包含它们
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	if s.hasPending() {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// update 打开数据库, 先写入排队的记录, 再执行读写事务 (fn 为 nil 时只写入排队的记录), 提交后关闭数据库, 释放文件锁
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	s.writePending(db)
+	if fn == nil {
+		return db.Close()
+	}
+	if err := db.Update(fn); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// queue 把写入排队, 最多 storeFlushDelay 后和其他排队的写入一起执行, 失败时只记录日志
+func (s *Store) queue(fn func(tx *bolt.Tx) error) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	s.pending = append(s.pending, fn)
+	if s.flushTimer == nil {
+		s.flushTimer = time.AfterFunc(storeFlushDelay, func() {
+			if err := s.Flush(); err != nil {
+				log.Printf("flush %s failed: %v", s.path, err)
+			}
+		})
+	}
+}
+
+func (s *Store) hasPending() bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return len(s.pending) > 0
+}
+
+// writePending 在打开的数据库中按顺序执行排队的写入, 每个写入一个事务, 一个失败不影响其他
+func (s *Store) writePending(db *bolt.DB) {
+	s.pendingMu.Lock()
+	pending := s.pending
+	s.pending = nil
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	s.pendingMu.Unlock()
+
+	for _, fn := range pending {
+		if err := db.Update(fn); err != nil {
+			log.Printf("write %s failed: %v", s.path, err)
+		}
+	}
+}
+
+// Flush 把排队的记录写入数据库, 程序退出前调用
+func (s *Store) Flush() error {
+	return s.update(nil)
+}
+
+// migrate 在一个事务中执行每个还没有执行的升级步骤
+func (s *Store) migrate() error {
+	for _, m := range migrations {
+		err := s.update(func(tx *bolt.Tx) error {
+			meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+			if err != nil {
+				return err
+			}
+			if schemaVersion(meta) >= m.version {
+				return nil
+			}
+			if err := m.apply(tx); err != nil {
+				return fmt.Errorf("version %d (%s): %w", m.version, m.name, err)
+			}
+			log.Printf("database migrated to version %d: %s", m.version, m.name)
+			return meta.Put(keySchemaVersion, itob(uint64(m.version)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaVersion 返回数据库当前的版本
+func (s *Store) SchemaVersion() (int, error) {
+	version := 0
+	err := s.view(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(bucketMeta); meta != nil {
+			version = schemaVersion(meta)
+		}
+		return nil
+	})
+	return version, err
+}
+
+func schemaVersion(meta *bolt.Bucket) int {
+	v := meta.Get(keySchemaVersion)
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// Users 返回所有用户, 按学号排序
+func (s *Store) Users() ([]storedUser, error) {
+	var users []storedUser
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+			var u storedUser
+			if err := json.Unmarshal(v, &u); err != nil {
+				return fmt.Errorf("decode user %s: %w", k, err)
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	return users, err
+}
+
+// User 返回一个用户, 没有时返回 errUserNotFound
+func (s *Store) User(userId string) (storedUser, error) {
+	var u storedUser
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketUsers).Get([]byte(userId))
+		if v == nil {
+			return fmt.Errorf("%w: 没有保存学号 %s 的用户", errUserNotFound, userId)
+		}
+		return json.Unmarshal(v, &u)
+	})
+	return u, err
+}
+
+// InsertUser 保存新用户, 学号已经存在时返回 errUserExists
+func (s *Store) InsertUser(u storedUser) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUsers)
+		if b.Get([]byte(u.UserId)) != nil {
+			return errUserExists
+		}
+		return putJSON(b, []byte(u.UserId), u)
+	})
+}
+
+// UpdateUser 在一个事务中修改用户, 没有时返回 errUserNotFound
+func (s *Store) UpdateUser(userId string, fn func(u *storedUser) error) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUsers)
+		v := b.Get([]byte(userId))
+		if v == nil {
+			return fmt.Errorf("%w: 没有保存学号 %s 的用户", errUserNotFound, userId)
+		}
+		var u storedUser
+		if err := json.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		if err := fn(&u); err != nil {
+			return err
+		}
+		return putJSON(b, []byte(userId), u)
+	})
+}
+
+// DeleteUser 删除用户, 没有时返回 errUserNotFound
+func (s *Store) DeleteUser(userId string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUsers)
+		if b.Get([]byte(userId)) == nil {
+			return fmt.Errorf("%w: 没有保存学号 %s 的用户", errUserNotFound, userId)
+		}
+		return b.Delete([]byte(userId))
+	})
+}
+
+// ImportUsers 导入旧版本的用户文件, 用于数据库升级后才恢复的 users 文件, 见 importUserFiles
+func (s *Store) ImportUsers() error {
+	return s.update(importUserFiles)
+}
+
+// CreateTask 保存新任务和任务的参数并分配 ID
+func (s *Store) CreateTask(info *GoroutineInfo, params taskParams) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketTasks)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		info.Identification = int(id)
+		if err := putJSON(b, itob(id), info); err != nil {
+			return err
+		}
+		return putJSON(tx.Bucket(bucketTaskParams), itob(id), params)
+	})
+}
+
+// TaskParams 返回还没有结束的任务的参数, 没有时返回 errTaskNotFound
+func (s *Store) TaskParams(id int) (taskParams, error) {
+	var params taskParams
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketTaskParams).Get(itob(uint64(id)))
+		if v == nil {
+			return fmt.Errorf("%w: %d", errTaskNotFound, id)
+		}
+		return json.Unmarshal(v, &params)
+	})
+	return params, err
+}
+
+// Task 返回一个任务, 没有时返回 errTaskNotFound
+func (s *Store) Task(id int) (GoroutineInfo, error) {
+	var info GoroutineInfo
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketTasks).Get(itob(uint64(id)))
+		if v == nil {
+			return fmt.Errorf("%w: %d", errTaskNotFound, id)
+		}
+		return json.Unmarshal(v, &info)
+	})
+	return info, err
+}
+
+// UpdateTask 在一个事务中修改任务, 没有时返回 errTaskNotFound
+func (s *Store) UpdateTask(id int, fn func(info *GoroutineInfo)) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return modifyTask(tx, id, fn)
+	})
+}
+
+// QueueTaskUpdate 把任务的修改排队, 见 queue. 抢票时使用, 不等待数据库
+func (s *Store) QueueTaskUpdate(id int, fn func(info *GoroutineInfo)) {
+	s.queue(func(tx *bolt.Tx) error {
+		return modifyTask(tx, id, fn)
+	})
+}
+
+// FinishTask 在一个事务中修改结束的任务并删除任务的参数, 没有时返回 errTaskNotFound
+func (s *Store) FinishTask(id int, fn func(info *GoroutineInfo)) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if err := modifyTask(tx, id, fn); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketTaskParams).Delete(itob(uint64(id)))
+	})
+}
+
+func modifyTask(tx *bolt.Tx, id int, fn func(info *GoroutineInfo)) error {
+	b := tx.Bucket(bucketTasks)
+	v := b.Get(itob(uint64(id)))
+	if v == nil {
+		return fmt.Errorf("%w: %d", errTaskNotFound, id)
+	}
+	var info GoroutineInfo
+	if err := json.Unmarshal(v, &info); err != nil {
+		return err
+	}
+	fn(&info)
+	return putJSON(b, itob(uint64(id)), info)
+}
+
+// Tasks 返回状态为 states 之一的任务, 没有 states 时返回所有任务, 按 ID 排序
+func (s *Store) Tasks(states ...string) ([]GoroutineInfo, error) {
+	var tasks []GoroutineInfo
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTasks).ForEach(func(k, v []byte) error {
+			var info GoroutineInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return fmt.Errorf("decode task %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			if len(states) == 0 || containsString(states, info.State) {
+				tasks = append(tasks, info)
+			}
+			return nil
+		})
+	})
+	return tasks, err
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// attemptRecord 是任务的一次预约尝试
+type attemptRecord struct {
+	TaskId int
+	Time   time.Time
+	// 时间段和备选
+	Slot string
+	// 失败的原因, 成功时为空
+	Error string
+}
+
+// AddAttempt 记录一次尝试, 按任务和时间顺序保存. 尝试先排队, 见 queue
+func (s *Store) AddAttempt(a attemptRecord) {
+	s.queue(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAttempts)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return putJSON(b, append(itob(uint64(a.TaskId)), itob(seq)...), a)
+	})
+}
+
+// Attempts 返回任务的所有尝试
+func (s *Store) Attempts(taskId int) ([]attemptRecord, error) {
+	var attempts []attemptRecord
+	prefix := itob(uint64(taskId))
+	err := s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketAttempts).Cursor()
+		for k, v := c.Seek(prefix); k != nil && string(k[:8]) == string(prefix); k, v = c.Next() {
+			var a attemptRecord
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			attempts = append(attempts, a)
+		}
+		return nil
+	})
+	return attempts, err
+}
+
+// bookingRecord 是一次预约成功的记录
+type bookingRecord struct {
+	TaskId    int
+	UserId    string
+	UserName  string
+	Date      string
+	Slot      string
+	CourtId   string
+	CourtName string
+	Place     string
+	Time      time.Time
+}
+
+// AddBooking 记录预约成功的场地, 先排队, 见 queue
+func (s *Store) AddBooking(b bookingRecord) {
+	s.queue(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketBookings)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		return putJSON(bucket, itob(seq), b)
+	})
+}
+
+// Bookings 返回所有预约记录, 先预约的在前
+func (s *Store) Bookings() ([]bookingRecord, error) {
+	var bookings []bookingRecord
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBookings).ForEach(func(k, v []byte) error {
+			var b bookingRecord
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			bookings = append(bookings, b)
+			return nil
+		})
+	})
+	return bookings, err
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"RubCourse/szutest"
+)
+
+// reopenStore 重新打开测试的数据库, 像重启程序一样
+func reopenStore(t *testing.T) {
+	t.Helper()
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openStore(config.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+}
+
+func TestOpenStoreImportsUsersFile(t *testing.T) {
+	newFakeSZU(t)
+	legacy := `[{"UserId":"2300271032","UserName":"测试","Password":"secret-one","PhoneNumber":"13800000000","SportDate":"","FirstTime":"","SecondTime":"","IfExecNow":""}]`
+	if err := ioutil.WriteFile(legacyUsersFile, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 新的数据库从版本 0 开始升级
+	config.DBFile = filepath.Join(t.TempDir(), "rub.db")
+	reopenStore(t)
+
+	if version, err := store.SchemaVersion(); err != nil || version != len(migrations) {
+		t.Errorf("schema version = %d, %v, want %d", version, err, len(migrations))
+	}
+	user, err := findUser("2300271032")
+	if err != nil {
+		t.Fatalf("findUser: %v", err)
+	}
+	if user.Password != "secret-one" || user.PhoneNumber != "13800000000" {
+		t.Errorf("user = %+v, want migrated password and phone", *user)
+	}
+	if _, err := os.Stat(legacyUsersFile); !os.IsNotExist(err) {
+		t.Errorf("plaintext users file still exists: %v", err)
+	}
+
+	info, err := os.Stat(config.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("database mode = %v, want 0600", perm)
+	}
+	data, _ := ioutil.ReadFile(config.DBFile)
+	if strings.Contains(string(data), "secret-one") {
+		t.Error("database contains the plaintext password")
+	}
+
+	// 已经升级过的数据库不会再导入
+	if err := ioutil.WriteFile(legacyUsersFile, []byte(`[]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reopenStore(t)
+	if _, err := os.Stat(legacyUsersFile); err != nil {
+		t.Errorf("users file imported again: %v", err)
+	}
+	if _, err := findUser("2300271032"); err != nil {
+		t.Errorf("findUser after reopen: %v", err)
+	}
+
+	if err := addUser(&UserInfo{UserId: "2300271032", UserName: "测试", Password: "other"}); err != errUserExists {
+		t.Errorf("addUser duplicate = %v, want %v", err, errUserExists)
+	}
+	if err := addUser(&UserInfo{UserId: "2350273008", UserName: "新用户", Password: "secret-two"}); err != nil {
+		t.Fatalf("addUser: %v", err)
+	}
+	if user, err := findUser("2350273008"); err != nil || user.Password != "secret-two" {
+		t.Errorf("findUser after add = %+v, %v", user, err)
+	}
+}
+
+func TestOpenStoreImportsCredentialFile(t *testing.T) {
+	newFakeSZU(t)
+	stored, err := sealUser(&UserInfo{UserId: testUserId, UserName: "测试", Password: testPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal([]storedUser{stored})
+	if err := ioutil.WriteFile(config.CredentialFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.DBFile = filepath.Join(t.TempDir(), "rub.db")
+	reopenStore(t)
+
+	if user, err := findUser(testUserId); err != nil || user.Password != testPassword {
+		t.Errorf("findUser = %+v, %v", user, err)
+	}
+	if _, err := os.Stat(config.CredentialFile); !os.IsNotExist(err) {
+		t.Errorf("credential file still exists: %v", err)
+	}
+}
+
+func TestImportUsersBackup(t *testing.T) {
+	newFakeSZU(t)
+	// git pull 删除了 users, 从 git 历史恢复到 users.bak
+	legacy := `[{"UserId":"2300271032","UserName":"测试","Password":"secret-one"}]`
+	if err := ioutil.WriteFile(legacyUsersBackup, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.DBFile = filepath.Join(t.TempDir(), "rub.db")
+	reopenStore(t)
+	if user, err := findUser("2300271032"); err != nil || user.Password != "secret-one" {
+		t.Errorf("findUser = %+v, %v", user, err)
+	}
+	if _, err := os.Stat(legacyUsersBackup); !os.IsNotExist(err) {
+		t.Errorf("users.bak still exists: %v", err)
+	}
+
+	// 数据库升级后才恢复的文件用 -user import 导入, 已经有的用户不覆盖
+	if code := runUserCLI("import", cliOptions{}, nil); code != exitUsage {
+		t.Errorf("import without file exit code = %d, want %d", code, exitUsage)
+	}
+	legacy = `[{"UserId":"2300271032","UserName":"测试","Password":"old"},{"UserId":"2350273008","UserName":"测试二","Password":"secret-two"}]`
+	if err := ioutil.WriteFile(legacyUsersBackup, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runUserCLI("import", cliOptions{}, nil); code != exitOK {
+		t.Fatalf("import exit code = %d", code)
+	}
+	if user, err := findUser("2300271032"); err != nil || user.Password != "secret-one" {
+		t.Errorf("existing user overwritten: %+v, %v", user, err)
+	}
+	if user, err := findUser("2350273008"); err != nil || user.Password != "secret-two" {
+		t.Errorf("imported user = %+v, %v", user, err)
+	}
+}
+
+func TestStartRubRecordsTaskInStore(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.Inject("/getTimeList.do", 1, szutest.Fault{Status: 500, Body: "busy"})
+	srv.OpenSlot(testDate, "20:00", "21:00", courtC6)
+
+	info, err := runTask(t, context.Background(), testUser("20:00-21:00"))
+	if err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	if info.State != stateBooked || !info.Slots[0].Booked {
+		t.Errorf("task = %+v, want booked", info)
+	}
+
+	attempts, err := store.Attempts(info.Identification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 || attempts[0].Error == "" || attempts[1].Error != "" {
+		t.Errorf("attempts = %+v, want one failure and one success", attempts)
+	}
+	bookings, err := store.Bookings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookings) != 1 || bookings[0].CourtId != courtC6 || bookings[0].Slot != "20:00-21:00" || bookings[0].TaskId != info.Identification {
+		t.Errorf("bookings = %+v, want %s at 20:00-21:00", bookings, courtC6)
+	}
+
+	// 重启后任务和预约记录还在
+	reopenStore(t)
+	if got, err := store.Task(info.Identification); err != nil || got.State != stateBooked {
+		t.Errorf("task after reopen = %+v, %v", got, err)
+	}
+	if _, err := store.Task(info.Identification + 1); !errors.Is(err, errTaskNotFound) {
+		t.Errorf("missing task err = %v, want %v", err, errTaskNotFound)
+	}
+}
+
+func TestResumeTasks(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00", courtD6)
+
+	// 模拟重启前保存的任务: 没有到抢票时间的, 错过抢票时间的和直接运行的
+	register := func(user *UserInfo) int {
+		t.Helper()
+		id, err := registerGoroutine(user, func() {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addLock.Lock()
+		delete(goroutines, id)
+		addLock.Unlock()
+		return id
+	}
+	pending := testUser("20:00-21:00")
+	pending.IfExecNow = ""
+	pending.Schedule.ReleaseTime = time.Now().Add(2 * time.Second).Format("15:04:05")
+	pending.Schedule.LoginLead = 500 * time.Millisecond
+	pendingId := register(pending)
+
+	missed := testUser("21:00-22:00")
+	missed.IfExecNow = ""
+	missedId := register(missed)
+	setNextFire(missedId, time.Now().Add(-time.Minute))
+
+	direct := register(testUser("19:00-20:00"))
+
+	// 还在命令行中运行的任务
+	elsewhere := register(testUser("18:00-19:00"))
+	if err := store.UpdateTask(elsewhere, func(info *GoroutineInfo) { info.Pid = os.Getppid() }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resumeTasks(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Task(elsewhere); err != nil || got.State != stateScheduled {
+		t.Errorf("task running in another process = %+v, %v, want %s", got, err, stateScheduled)
+	}
+	for id, want := range map[int]string{missedId: stateExpired, direct: stateFailed} {
+		if got, err := store.Task(id); err != nil || got.State != want {
+			t.Errorf("task %d = %+v, %v, want %s", id, got, err, want)
+		}
+		if _, err := store.TaskParams(id); !errors.Is(err, errTaskNotFound) {
+			t.Errorf("params of finished task %d err = %v, want %v", id, err, errTaskNotFound)
+		}
+	}
+
+	addLock.Lock()
+	handle, ok := goroutines[pendingId]
+	addLock.Unlock()
+	if !ok {
+		t.Fatal("pending task not resumed")
+	}
+	select {
+	case <-handle.done:
+	case <-time.After(10 * time.Second):
+		handle.cancel()
+		t.Fatal("resumed task did not finish")
+	}
+	if got, err := store.Task(pendingId); err != nil || got.State != stateBooked {
+		t.Errorf("resumed task = %+v, %v, want %s", got, err, stateBooked)
+	}
+	if bookings := srv.Bookings(); len(bookings) != 1 || bookings[0].KYYSJD != "20:00-21:00" {
+		t.Errorf("bookings = %+v, want 20:00-21:00", bookings)
+	}
+}
+
+func TestStoreSharedWithAnotherProcess(t *testing.T) {
+	newFakeSZU(t)
+	// 网页运行时命令行打开同一个数据库
+	cli, err := openStore(config.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.InsertUser(storedUser{UserId: "2300271032", UserName: "测试"}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := store.User("2300271032"); err != nil || u.UserName != "测试" {
+		t.Errorf("user added by the other store = %+v, %v", u, err)
+	}
+
+	// 另一个进程正在写时等它写完
+	writing := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- cli.update(func(tx *bolt.Tx) error {
+			close(writing)
+			time.Sleep(300 * time.Millisecond)
+			return nil
+		})
+	}()
+	<-writing
+	start := time.Now()
+	if err := store.DeleteUser("2300271032"); err != nil {
+		t.Errorf("DeleteUser while another process writes: %v", err)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("DeleteUser waited %v, want it to wait for the other write", waited)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// 抢票时的记录不等另一个进程写完
+	id, err := registerGoroutine(testUser("20:00-21:00"), func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writing = make(chan struct{})
+	go func() {
+		done <- cli.update(func(tx *bolt.Tx) error {
+			close(writing)
+			time.Sleep(300 * time.Millisecond)
+			return nil
+		})
+	}()
+	<-writing
+	start = time.Now()
+	recordSlot(context.Background(), id, 0, testUser("20:00-21:00").Slots[0], TimeSlot{}, errSlotGone)
+	if waited := time.Since(start); waited > 100*time.Millisecond {
+		t.Errorf("recordSlot waited %v for the other process", waited)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// 另一个进程稍后读到排队的记录
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		attempts, err := cli.Attempts(id)
+		info, _ := cli.Task(id)
+		if err == nil && len(attempts) == 1 && info.Attempts == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("attempts = %+v, %v, task = %+v, want the queued attempt", attempts, err, info)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,633 @@
+// Package szutest 提供本地的假 authserver 和 ehall 场馆预约服务, 用于离线测试
+package szutest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"RubCourse/cas"
+	"RubCourse/ehall"
+)
+
+// ehall 场馆预约的路径前缀, 和真实服务一致
+const appPrefix = "/qljfwapp/sys/lwSzuCgyy"
+
+// 场地列表在另一个应用下, 和旧版本使用的地址一样
+const courtsPath = "/publicapp/sys/tycgyyxt/sportVenue/getCdxx.do"
+
+// Court 是一个场地
+type Court struct {
+	WID  string
+	Name string
+	// 为空的字段使用默认的场馆、项目和校区
+	Place ehall.Place
+}
+
+// placeNames 是场馆、项目和校区代码对应的 *_DISPLAY, 没有列出的直接显示代码
+var placeNames = map[string]string{
+	"CGBM:001": "南区体育馆",
+	"CGBM:002": "北区体育馆",
+	"XMDM:001": "羽毛球",
+	"XMDM:002": "乒乓球",
+	"XMDM:003": "网球",
+	"XQDM:1":   "粤海校区",
+	"XQDM:2":   "丽湖校区",
+}
+
+func placeName(field, code string) string {
+	if name, ok := placeNames[field+":"+code]; ok {
+		return name
+	}
+	return code
+}
+
+// Booking 是一条预约成功的记录
+type Booking struct {
+	UserId string
+	CDWID  string
+	Date   string
+	// 例如 20:00-21:00
+	KYYSJD string
+	Place  ehall.Place
+}
+
+// Fault 是注入到某个接口的故障
+type Fault struct {
+	// 返回的状态码, 为 0 时不修改
+	Status int
+	// 不为空时直接返回这个内容
+	Body string
+	// 处理前等待
+	Delay time.Duration
+	// 让所有会话失效, 请求会被跳转到 authserver
+	ExpireSessions bool
+	// 直接断开连接, 模拟网络错误
+	Drop bool
+}
+
+type fault struct {
+	path  string
+	times int
+	Fault
+}
+
+// Server 是假的 authserver 和 ehall, 两者使用不同的端口
+type Server struct {
+	Auth  *httptest.Server
+	Ehall *httptest.Server
+
+	// ehall 的 Date 头比真实时间快多少
+	ClockSkew time.Duration
+
+	mu       sync.Mutex
+	salt     string
+	users    map[string]string
+	tickets  map[string]string
+	casAuth  map[string]string
+	weu      map[string]string
+	courts   []Court
+	slots    map[string]map[string]bool
+	booked   map[string]bool
+	bookings []Booking
+	faults   []*fault
+	calls    map[string]int
+	seq      int
+	// 成功登录的次数
+	logins int
+}
+
+func NewServer() *Server {
+	s := &Server{
+		salt:    "rjBFAaHsNkKAhpoi",
+		users:   make(map[string]string),
+		tickets: make(map[string]string),
+		casAuth: make(map[string]string),
+		weu:     make(map[string]string),
+		slots:   make(map[string]map[string]bool),
+		booked:  make(map[string]bool),
+		calls:   make(map[string]int),
+	}
+	s.Auth = httptest.NewServer(http.HandlerFunc(s.serveAuth))
+	s.Ehall = httptest.NewServer(http.HandlerFunc(s.serveEhall))
+	return s
+}
+
+func (s *Server) Close() {
+	s.Auth.Close()
+	s.Ehall.Close()
+}
+
+// LoginURL 对应 cas.DefaultLoginURL
+func (s *Server) LoginURL() string {
+	return s.Auth.URL + "/authserver/login"
+}
+
+// EhallURL 对应 ehall.DefaultBaseURL
+func (s *Server) EhallURL() string {
+	return s.Ehall.URL + appPrefix
+}
+
+// CASClient 返回登录这个服务器的 cas.Client
+func (s *Server) CASClient() *cas.Client {
+	c := cas.NewClient()
+	c.LoginURL = s.LoginURL()
+	c.Service = s.EhallURL() + "/index.do#/sportVenue"
+	c.EhallURL = s.EhallURL()
+	return c
+}
+
+// EhallClient 返回访问这个服务器的 ehall.Client
+func (s *Server) EhallClient(session *ehall.Session) *ehall.Client {
+	c := ehall.NewClient(session)
+	c.BaseURL = s.EhallURL()
+	c.CourtsURL = s.CourtsURL()
+	return c
+}
+
+// CourtsURL 对应 ehall.DefaultCourtsURL
+func (s *Server) CourtsURL() string {
+	return s.Ehall.URL + courtsPath
+}
+
+// AddUser 添加可以登录的学号和密码
+func (s *Server) AddUser(userId, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[userId] = password
+}
+
+// AddCourts 添加场地
+func (s *Server) AddCourts(courts ...Court) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range courts {
+		c.Place = c.Place.WithDefaults()
+		s.courts = append(s.courts, c)
+	}
+}
+
+// OpenSlot 开放某天某个时间段, courtIDs 为空时开放所有场地
+func (s *Server) OpenSlot(date, start, end string, courtIDs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := date + " " + start + "-" + end
+	if s.slots[key] == nil {
+		s.slots[key] = make(map[string]bool)
+	}
+	if len(courtIDs) == 0 {
+		for _, c := range s.courts {
+			courtIDs = append(courtIDs, c.WID)
+		}
+	}
+	for _, id := range courtIDs {
+		s.slots[key][id] = true
+	}
+}
+
+// Bookings 返回所有预约成功的记录
+func (s *Server) Bookings() []Booking {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Booking(nil), s.bookings...)
+}
+
+// Calls 返回路径以 path 结尾的请求次数
+func (s *Server) Calls(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for p, count := range s.calls {
+		if strings.HasSuffix(p, path) {
+			n += count
+		}
+	}
+	return n
+}
+
+// Logins 返回用户名密码正确的登录次数
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+// Inject 让接下来 times 次路径以 path 结尾的请求出现故障
+func (s *Server) Inject(path string, times int, f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault{path: path, times: times, Fault: f})
+}
+
+// ExpireSessions 让所有已登录的会话失效
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.casAuth = make(map[string]string)
+	s.weu = make(map[string]string)
+}
+
+// applyFault 处理注入的故障, 返回 true 表示请求已经处理完
+func (s *Server) applyFault(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	s.calls[r.URL.Path]++
+	var f *fault
+	for _, v := range s.faults {
+		if v.times > 0 && strings.HasSuffix(r.URL.Path, v.path) {
+			v.times--
+			f = v
+			break
+		}
+	}
+	if f != nil && f.ExpireSessions {
+		s.casAuth = make(map[string]string)
+		s.weu = make(map[string]string)
+	}
+	s.mu.Unlock()
+
+	if f == nil {
+		return false
+	}
+	if f.Delay > 0 {
+		// 读完请求体后客户端断开时 r.Context() 才会取消
+		r.ParseForm()
+		select {
+		case <-time.After(f.Delay):
+		case <-r.Context().Done():
+			return true
+		}
+	}
+	if f.Drop {
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return true
+			}
+		}
+	}
+	if f.Body != "" || f.Status != 0 {
+		if f.Status != 0 {
+			w.WriteHeader(f.Status)
+		}
+		w.Write([]byte(f.Body))
+		return true
+	}
+	return false
+}
+
+func (s *Server) nextID(prefix string) string {
+	s.seq++
+	return fmt.Sprintf("%s-%d", prefix, s.seq)
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html><body>
+{{ if .Error }}<span id="showErrorTip">{{ .Error }}</span>{{ end }}
+<form id="pwdFromId" method="post">
+<input id="username" name="username" value="">
+<input id="password" name="password" value="">
+<input type="hidden" name="lt" value="">
+<input type="hidden" name="dllt" value="generalLogin">
+<input type="hidden" name="execution" value="e1s1">
+<input type="hidden" name="_eventId" value="submit">
+<input type="hidden" id="pwdEncryptSalt" value="{{ .Salt }}">
+</form>
+</body></html>`))
+
+func (s *Server) serveAuth(w http.ResponseWriter, r *http.Request) {
+	if s.applyFault(w, r) {
+		return
+	}
+	if r.URL.Path != "/authserver/login" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	salt := s.salt
+	s.mu.Unlock()
+
+	if r.Method != http.MethodPost {
+		loginPage.Execute(w, struct{ Salt, Error string }{salt, ""})
+		return
+	}
+
+	userId := r.FormValue("username")
+	password, err := decryptPassword(r.FormValue("password"), salt)
+	s.mu.Lock()
+	want, ok := s.users[userId]
+	s.mu.Unlock()
+	if err != nil || !ok || password != want || r.FormValue("execution") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		loginPage.Execute(w, struct{ Salt, Error string }{salt, "您提供的用户名或者密码有误"})
+		return
+	}
+
+	service := r.URL.Query().Get("service")
+	if i := strings.Index(service, "#"); i >= 0 {
+		service = service[:i]
+	}
+	s.mu.Lock()
+	ticket := s.nextID("ST")
+	s.logins++
+	s.tickets[ticket] = userId
+	s.mu.Unlock()
+	http.Redirect(w, r, service+"?ticket="+url.QueryEscape(ticket), http.StatusFound)
+}
+
+// decryptPassword 解密 cas.AESEncryptor 的结果. iv 不知道, 但它只影响前缀的第一个块
+func decryptPassword(encrypted, salt string) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher([]byte(salt))
+	if err != nil {
+		return "", err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return "", fmt.Errorf("bad ciphertext length %d", len(ciphertext))
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(plaintext, ciphertext)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || len(plaintext)-padding < 64 {
+		return "", fmt.Errorf("bad padding")
+	}
+	return string(plaintext[64 : len(plaintext)-padding]), nil
+}
+
+func (s *Server) serveEhall(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Date", time.Now().Add(s.ClockSkew).UTC().Format(http.TimeFormat))
+	if s.applyFault(w, r) {
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, appPrefix)
+	switch {
+	case r.URL.Path == courtsPath:
+		path = "/sportVenue/getCdxx.do"
+	case !strings.HasPrefix(r.URL.Path, appPrefix+"/"):
+		http.NotFound(w, r)
+		return
+	}
+
+	if path == "/index.do" {
+		s.serveIndex(w, r)
+		return
+	}
+
+	userId, ok := s.authenticated(r)
+	if r.URL.Path == courtsPath {
+		// 公共应用没有预约应用的 _WEU, 只看 CAS 登录
+		userId, ok = s.casUser(r)
+	}
+	if !ok {
+		s.redirectToLogin(w, r)
+		return
+	}
+
+	switch path {
+	case "/sportVenue/getOrderNum.do":
+		s.writeJSON(w, ehall.DH{DHID: s.lockedID("DH")})
+	case "/sportVenue/getTimeList.do":
+		// 和真实服务一样会刷新 _WEU
+		s.setWEU(w, userId)
+		s.writeJSON(w, s.timeList(r.FormValue("YYRQ"), ehall.Place{Sport: r.FormValue("XMDM"), Campus: r.FormValue("XQ")}))
+	case "/modules/sportVenue/getOpeningRoom.do":
+		place := ehall.Place{Sport: r.FormValue("XMDM"), Campus: r.FormValue("XQDM")}
+		rows := s.openingRooms(r.FormValue("YYRQ"), r.FormValue("KSSJ"), r.FormValue("JSSJ"), place)
+		resp := ehall.OpenRoomResponse{Code: "0"}
+		resp.Datas.GetOpeningRoom = ehall.OpenRoomObject{PageNumber: 1, PageSize: len(rows), TotalSize: len(rows), Rows: rows}
+		s.writeJSON(w, resp)
+	case "/sportVenue/getCdxx.do":
+		s.writeJSON(w, s.courtList(r.FormValue("CGBM"), r.FormValue("XMDM")))
+	case "/sportVenue/insertVenueBookingInfo.do":
+		s.insert(w, r, userId)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) lockedID(prefix string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextID(prefix)
+}
+
+// serveIndex 处理 CAS 的 ticket 和登录后的首页
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		s.mu.Lock()
+		userId, ok := s.tickets[ticket]
+		delete(s.tickets, ticket)
+		token := s.nextID("CAS")
+		if ok {
+			s.casAuth[token] = userId
+		}
+		s.mu.Unlock()
+		if !ok {
+			s.redirectToLogin(w, r)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "MOD_AUTH_CAS", Value: token, Path: "/"})
+		http.Redirect(w, r, appPrefix+"/index.do", http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	cookie, err := r.Cookie("MOD_AUTH_CAS")
+	s.mu.Lock()
+	userId, ok := "", false
+	if err == nil {
+		userId, ok = s.casAuth[cookie.Value]
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.redirectToLogin(w, r)
+		return
+	}
+	s.setWEU(w, userId)
+	w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	w.Write([]byte("<html><body>场馆预约</body></html>"))
+}
+
+func (s *Server) setWEU(w http.ResponseWriter, userId string) {
+	s.mu.Lock()
+	token := s.nextID("WEU")
+	s.weu[token] = userId
+	s.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: "_WEU", Value: token, Path: appPrefix})
+}
+
+// authenticated 检查 MOD_AUTH_CAS 和 _WEU 是否属于同一个已登录的学号
+func (s *Server) authenticated(r *http.Request) (string, bool) {
+	userId, ok := s.casUser(r)
+	if !ok {
+		return "", false
+	}
+	weu, err := r.Cookie("_WEU")
+	if err != nil {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.weu[weu.Value] != userId {
+		return "", false
+	}
+	return userId, true
+}
+
+// casUser 返回 MOD_AUTH_CAS 登录的学号
+func (s *Server) casUser(r *http.Request) (string, bool) {
+	cas, err := r.Cookie("MOD_AUTH_CAS")
+	if err != nil {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	userId, ok := s.casAuth[cas.Value]
+	return userId, ok
+}
+
+func (s *Server) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	service := s.Ehall.URL + appPrefix + "/index.do"
+	http.Redirect(w, r, s.LoginURL()+"?service="+url.QueryEscape(service), http.StatusFound)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) courtList(venue, sport string) []ehall.Court {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	courts := make([]ehall.Court, 0, len(s.courts))
+	for _, c := range s.courts {
+		if c.Place.Venue == venue && c.Place.Sport == sport {
+			courts = append(courts, ehall.Court{Id: c.WID, Name: c.Name})
+		}
+	}
+	return courts
+}
+
+// court 返回场地, 调用时需要持有 s.mu
+func (s *Server) court(wid string) (Court, bool) {
+	for _, c := range s.courts {
+		if c.WID == wid {
+			return c, true
+		}
+	}
+	return Court{}, false
+}
+
+// RenameCourt 修改场地的名字
+func (s *Server) RenameCourt(wid, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.courts {
+		if s.courts[i].WID == wid {
+			s.courts[i].Name = name
+		}
+	}
+}
+
+// timeList 返回项目和校区的时间段, 有一个场地空闲时可以预约
+func (s *Server) timeList(date string, place ehall.Place) []ehall.KYY {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []ehall.KYY
+	for key, courts := range s.slots {
+		if !strings.HasPrefix(key, date+" ") {
+			continue
+		}
+		code := strings.TrimPrefix(key, date+" ")
+		free := false
+		for id, open := range courts {
+			c, ok := s.court(id)
+			if ok && c.Place.Sport == place.Sport && c.Place.Campus == place.Campus && open && !s.booked[key+" "+id] {
+				free = true
+			}
+		}
+		kyy := ehall.KYY{CODE: code, NAME: code, WID: code, Disabled: !free, Text: "已约满"}
+		if free {
+			kyy.Text = ehall.TextAvailable
+		}
+		list = append(list, kyy)
+	}
+	return list
+}
+
+// openingRooms 返回项目和校区所有场馆的场地
+func (s *Server) openingRooms(date, start, end string, place ehall.Place) []ehall.OpenRoomData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := date + " " + start + "-" + end
+	var rows []ehall.OpenRoomData
+	for _, c := range s.courts {
+		if c.Place.Sport != place.Sport || c.Place.Campus != place.Campus {
+			continue
+		}
+		free := s.slots[key][c.WID] && !s.booked[key+" "+c.WID]
+		row := ehall.OpenRoomData{
+			WID:          c.WID,
+			CDMC:         c.Name,
+			CGBM:         c.Place.Venue,
+			CGBM_DISPLAY: placeName("CGBM", c.Place.Venue),
+			XMDM:         c.Place.Sport,
+			XMDM_DISPLAY: placeName("XMDM", c.Place.Sport),
+			XQDM:         c.Place.Campus,
+			XQDM_DISPLAY: placeName("XQDM", c.Place.Campus),
+			Disabled:     !free,
+			Text:         "已预约",
+		}
+		if free {
+			row.Text = ehall.TextAvailable
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func (s *Server) insert(w http.ResponseWriter, r *http.Request, userId string) {
+	date := r.FormValue("YYRQ")
+	code := r.FormValue("KYYSJD")
+	courtID := r.FormValue("CDWID")
+	key := date + " " + code
+	place := ehall.Place{Venue: r.FormValue("CGDM"), Sport: r.FormValue("XMDM"), Campus: r.FormValue("XQWID")}
+
+	s.mu.Lock()
+	c, ok := s.court(courtID)
+	// 场馆、项目或校区和场地不一致时提交失败
+	// 不知道真实服务会不会拒绝同一个人同一个时间段的第二个场地, 这里不拒绝
+	free := ok && c.Place == place && s.slots[key][courtID] && !s.booked[key+" "+courtID]
+	if free {
+		s.booked[key+" "+courtID] = true
+		s.bookings = append(s.bookings, Booking{UserId: userId, CDWID: courtID, Date: date, KYYSJD: code, Place: place})
+	}
+	s.mu.Unlock()
+
+	var body bytes.Buffer
+	if free {
+		body.WriteString(`{"code":"0","msg":"预约成功","success":true}`)
+	} else {
+		body.WriteString(`{"code":"1","msg":"该场地已被预约","success":false}`)
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Write(body.Bytes())
+}
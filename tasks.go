@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+
+	"RubCourse/ehall"
+)
+
+// taskTransitions 是每个状态可以转换到的状态, 没有列出的是结束状态:
+// 等待抢票 -> 登录中 -> 抢票中 -> 成功/部分成功/失败/已取消/已过期
+var taskTransitions = map[string][]string{
+	stateScheduled: {stateLoggingIn, stateFailed, stateCancelled, stateExpired},
+	stateLoggingIn: {statePolling, stateFailed, stateCancelled, stateExpired},
+	statePolling:   {stateBooked, statePartial, stateFailed, stateCancelled, stateExpired},
+}
+
+// activeStates 是还没有结束的任务的状态
+var activeStates = []string{stateScheduled, stateLoggingIn, statePolling}
+
+var errBadTransition = errors.New("任务状态不能这样转换")
+
+// transition 把任务转换到状态 to 并记录时间
+func (g *GoroutineInfo) transition(to string, now time.Time) error {
+	if !containsString(taskTransitions[g.State], to) {
+		return fmt.Errorf("%w: %s -> %s", errBadTransition, g.State, to)
+	}
+	g.State = to
+	g.UpdatedAt = now
+	switch {
+	case to == stateLoggingIn:
+		g.StartedAt = now
+	case taskTransitions[to] == nil:
+		g.FinishedAt = now
+	}
+	return nil
+}
+
+// Finished 表示任务已经结束
+func (g GoroutineInfo) Finished() bool {
+	return taskTransitions[g.State] == nil
+}
+
+// setTaskState 转换任务的状态, 不允许的转换只记录日志
+func setTaskState(goroutineID int, to string) {
+	updateTask(goroutineID, func(info *GoroutineInfo) {
+		if err := info.transition(to, time.Now()); err != nil {
+			log.Printf("task %d: %v", goroutineID, err)
+		}
+	})
+}
+
+// finalState 按任务的结果决定结束状态, 没有完成但预约到了时间段时为部分成功
+func finalState(info *GoroutineInfo, err error) string {
+	if err == nil {
+		return stateBooked
+	}
+	for _, v := range info.Slots {
+		if v.Booked {
+			return statePartial
+		}
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return stateCancelled
+	case errors.Is(err, errExpired):
+		return stateExpired
+	}
+	return stateFailed
+}
+
+// taskMessage 返回任务结束后显示的结果, 例如 "成功 (演练)" 或 "失败: 登录失败"
+func taskMessage(info GoroutineInfo) string {
+	message := info.State
+	if info.DryRun {
+		message += " (演练)"
+	}
+	if info.Error != "" {
+		message += ": " + info.Error
+	}
+	return message
+}
+
+// slotsDeadline 返回任务的最后一个时间段 (包括备选) 开始的时间, 之后不再抢票. 日期格式错误时返回零值
+func slotsDeadline(user *UserInfo) time.Time {
+	var deadline time.Time
+	for _, choice := range user.Slots {
+		for _, slot := range choice {
+			start, err := time.ParseInLocation("2006-01-02 15:04", user.SportDate+" "+slot.Start, time.Local)
+			if err != nil {
+				return time.Time{}
+			}
+			if start.After(deadline) {
+				deadline = start
+			}
+		}
+	}
+	return deadline
+}
+
+// taskParams 是任务的全部参数, 任务结束前保存在数据库中, 重启后用来恢复任务. 密码用主密钥加密
+type taskParams struct {
+	UserId      string
+	UserName    string
+	PhoneNumber string
+	Password    []byte
+	SportDate   string
+	IfExecNow   string
+	Slots       []SlotChoice
+	Policy      CompletionPolicy
+	Schedule    Schedule
+	DryRun      bool
+	Courts      CourtPreference
+	TaskCourts  CourtPreference
+	Place       ehall.Place
+}
+
+func sealTask(user *UserInfo) (taskParams, error) {
+	password, err := encryptSecret([]byte(user.Password))
+	if err != nil {
+		return taskParams{}, fmt.Errorf("encrypt password of %s: %w", user.UserId, err)
+	}
+	return taskParams{
+		UserId:      user.UserId,
+		UserName:    user.UserName,
+		PhoneNumber: user.PhoneNumber,
+		Password:    password,
+		SportDate:   user.SportDate,
+		IfExecNow:   user.IfExecNow,
+		Slots:       user.Slots,
+		Policy:      user.Policy,
+		Schedule:    user.Schedule,
+		DryRun:      user.DryRun,
+		Courts:      user.Courts,
+		TaskCourts:  user.TaskCourts,
+		Place:       user.Place,
+	}, nil
+}
+
+func (p taskParams) open() (*UserInfo, error) {
+	password, err := decryptSecret(p.Password)
+	if err != nil {
+		return nil, fmt.Errorf("password of %s: %w", p.UserId, err)
+	}
+	return &UserInfo{
+		UserId:      p.UserId,
+		UserName:    p.UserName,
+		Password:    string(password),
+		PhoneNumber: p.PhoneNumber,
+		SportDate:   p.SportDate,
+		IfExecNow:   p.IfExecNow,
+		Slots:       p.Slots,
+		Policy:      p.Policy,
+		Schedule:    p.Schedule,
+		DryRun:      p.DryRun,
+		Courts:      p.Courts,
+		TaskCourts:  p.TaskCourts,
+		Place:       p.Place,
+	}, nil
+}
+
+// resumeTasks 恢复上次退出时还没有结束的任务. 程序没有运行时错过了抢票时间的任务标记为已过期,
+// 已经开始抢票的任务和无法恢复的任务标记为失败. 还在其他进程 (例如命令行) 中运行的任务不恢复
+func resumeTasks() error {
+	tasks, err := store.Tasks(activeStates...)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, v := range tasks {
+		id := v.Identification
+		if v.Pid != 0 && v.Pid != os.Getpid() && processRunning(v.Pid) {
+			log.Printf("task %d of %s is running in process %d", id, v.UserName, v.Pid)
+			continue
+		}
+		params, err := store.TaskParams(id)
+		var user *UserInfo
+		if err == nil {
+			user, err = params.open()
+		}
+
+		switch {
+		case err != nil:
+			log.Printf("task %d of %s cannot be resumed: %v", id, v.UserName, err)
+			err = finishTask(id, stateFailed, "无法恢复任务: "+err.Error())
+		case user.IfExecNow != "" || v.State != stateScheduled:
+			log.Printf("task %d of %s was interrupted", id, v.UserName)
+			err = finishTask(id, stateFailed, "程序退出时任务中断")
+		case fireMissed(v.NextFire, now):
+			log.Printf("task %d of %s missed its fire time %s", id, v.UserName, v.NextFire)
+			err = finishTask(id, stateExpired, "程序没有运行时错过了抢票时间")
+		default:
+			log.Printf("task %d of %s resumed", id, v.UserName)
+			if err := store.UpdateTask(id, func(info *GoroutineInfo) { info.Pid = os.Getpid() }); err != nil {
+				return err
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			addHandle(id, cancel)
+			go func() {
+				err := startRub(ctx, user, id)
+				unregisterGoroutine(id, err)
+				if err != nil {
+					log.Printf("task %d failed: %v", id, err)
+				}
+			}()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processRunning 判断进程是否还在运行
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Windows 上只能找到正在运行的进程
+	if runtime.GOOS == "windows" {
+		p.Release()
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// fireMissed 判断任务的抢票时间是否已经过了, 还没有算出抢票时间时重新计算
+func fireMissed(nextFire string, now time.Time) bool {
+	if nextFire == "" {
+		return false
+	}
+	fire, err := time.ParseInLocation("2006-01-02 15:04:05", nextFire, time.Local)
+	return err == nil && !fire.After(now)
+}
+
+// finishTask 记录恢复不了的任务的最终状态
+func finishTask(id int, state string, reason string) error {
+	return store.FinishTask(id, func(info *GoroutineInfo) {
+		if err := info.transition(state, time.Now()); err != nil {
+			log.Printf("task %d: %v", id, err)
+		}
+		info.Error = reason
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"RubCourse/szutest"
+)
+
+func TestTaskTransitions(t *testing.T) {
+	tests := []struct {
+		from, to string
+		ok       bool
+	}{
+		{stateScheduled, stateLoggingIn, true},
+		{stateScheduled, stateCancelled, true},
+		{stateScheduled, statePolling, false},
+		{stateLoggingIn, statePolling, true},
+		{stateLoggingIn, stateBooked, false},
+		{statePolling, statePartial, true},
+		{statePolling, stateExpired, true},
+		{stateBooked, stateFailed, false},
+		{stateCancelled, stateScheduled, false},
+	}
+	now := time.Now()
+	for _, tt := range tests {
+		info := GoroutineInfo{State: tt.from}
+		err := info.transition(tt.to, now)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s -> %s err = %v, want ok %v", tt.from, tt.to, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			if !errors.Is(err, errBadTransition) || info.State != tt.from {
+				t.Errorf("%s -> %s = %v, state %s", tt.from, tt.to, err, info.State)
+			}
+			continue
+		}
+		if info.Finished() != (taskTransitions[tt.to] == nil) || !info.UpdatedAt.Equal(now) {
+			t.Errorf("%s -> %s = %+v", tt.from, tt.to, info)
+		}
+	}
+}
+
+func TestStartRubTaskLifecycle(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.Inject("/getTimeList.do", 1, szutest.Fault{Status: 500, Body: "busy"})
+	srv.OpenSlot(testDate, "20:00", "21:00", courtD6)
+
+	info, err := runTask(t, context.Background(), testUser("20:00-21:00"))
+	if err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+	if info.State != stateBooked || info.Attempts != 2 {
+		t.Errorf("task = %+v, want booked after 2 attempts", info)
+	}
+	if info.CreatedAt.IsZero() || info.StartedAt.Before(info.CreatedAt) || info.FinishedAt.Before(info.StartedAt) {
+		t.Errorf("timestamps created %v started %v finished %v", info.CreatedAt, info.StartedAt, info.FinishedAt)
+	}
+}
+
+func TestStartRubPartiallyBooked(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00")
+
+	// 21:00 一直没有放出来, 预约到 20:00 后取消任务
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+	info, err := runTask(t, ctx, testUser("20:00-21:00,21:00-22:00"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if info.State != statePartial || info.Error != "" || !info.Slots[0].Booked {
+		t.Errorf("task = %+v, want partially booked", info)
+	}
+}
+
+func TestStartRubExpiresAfterSlotsStart(t *testing.T) {
+	srv := newFakeSZU(t)
+	user := testUser("20:00-21:00")
+	user.SportDate = "2023-09-17"
+	srv.OpenSlot(user.SportDate, "20:00", "21:00")
+
+	info, err := runTask(t, context.Background(), user)
+	if !errors.Is(err, errExpired) {
+		t.Fatalf("err = %v, want %v", err, errExpired)
+	}
+	if info.State != stateExpired || !info.StartedAt.IsZero() {
+		t.Errorf("task = %+v, want expired before logging in", info)
+	}
+	if n := len(srv.Bookings()); n != 0 {
+		t.Errorf("got %d bookings, want 0", n)
+	}
+}
+
+func TestTasksPageShowsHistory(t *testing.T) {
+	srv := newFakeSZU(t)
+	srv.OpenSlot(testDate, "20:00", "21:00", courtD6)
+	info, err := runTask(t, context.Background(), testUser("20:00-21:00"))
+	if err != nil {
+		t.Fatalf("startRub: %v", err)
+	}
+
+	get := func(target string) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		tasks(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Body.String()
+	}
+	if body := get("/tasks"); !strings.Contains(body, fmt.Sprintf("tasks?id=%d", info.Identification)) || !strings.Contains(body, stateBooked) {
+		t.Error("history does not list the finished task")
+	}
+	if body := get(fmt.Sprintf("/tasks?id=%d", info.Identification)); !strings.Contains(body, "羽毛球场D6") || !strings.Contains(body, "尝试次数: 1") {
+		t.Error("task page does not show the booking and attempts")
+	}
+}
+
+func TestStopPageTaskOfOtherProcess(t *testing.T) {
+	newFakeSZU(t)
+	// 命令行中运行的任务
+	id, err := registerGoroutine(testUser("20:00-21:00"), func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addLock.Lock()
+	delete(goroutines, id)
+	addLock.Unlock()
+	if err := store.UpdateTask(id, func(info *GoroutineInfo) { info.Pid = os.Getppid() }); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	stop(rec, httptest.NewRequest(http.MethodGet, "/stop", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "由其他进程") || strings.Contains(body, `value="删除"`) {
+		t.Error("stop page offers to stop a task of another process")
+	}
+
+	form := url.Values{"identification": {fmt.Sprint(id)}, "user_id": {testUserId}}
+	req := httptest.NewRequest(http.MethodPost, "/stop", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	stop(rec, req)
+	if body := rec.Body.String(); !strings.Contains(body, "无法从网页停止") || !strings.Contains(body, fmt.Sprint(os.Getppid())) {
+		t.Errorf("stop response does not explain the task runs elsewhere:\n%s", body)
+	}
+	if info, err := store.Task(id); err != nil || info.State != stateScheduled {
+		t.Errorf("task = %+v, %v, want it untouched", info, err)
+	}
+}
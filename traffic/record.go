@@ -0,0 +1,182 @@
+// Package traffic 记录和回放与 ehall、authserver 之间的 HTTP 请求
+package traffic
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redacted 替换密码、cookie 和 ticket 的值
+const Redacted = "REDACTED"
+
+// Exchange 是一次请求和响应, 记录文件每行一个
+type Exchange struct {
+	Seq      int
+	Time     time.Time
+	Duration time.Duration
+
+	Method        string
+	URL           string
+	RequestHeader http.Header `json:",omitempty"`
+	RequestBody   string      `json:",omitempty"`
+
+	Status         int         `json:",omitempty"`
+	ResponseHeader http.Header `json:",omitempty"`
+	ResponseBody   string      `json:",omitempty"`
+	// 请求没有得到响应时的错误
+	Error string `json:",omitempty"`
+}
+
+// Recorder 是记录所有请求的 http.RoundTripper, 密码和 cookie 会被隐去
+type Recorder struct {
+	// 实际发送请求, 为 nil 时使用 http.DefaultTransport
+	Transport http.RoundTripper
+
+	mu  sync.Mutex
+	w   io.Writer
+	seq int
+}
+
+func NewRecorder(w io.Writer, transport http.RoundTripper) *Recorder {
+	return &Recorder{Transport: transport, w: w}
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err == nil {
+			reqBody, _ = ioutil.ReadAll(body)
+			body.Close()
+		}
+	}
+
+	ex := Exchange{
+		Time:          time.Now(),
+		Method:        req.Method,
+		URL:           redactURL(req.URL.String()),
+		RequestHeader: redactHeader(req.Header),
+		RequestBody:   redactBody(req.Header.Get("Content-Type"), reqBody),
+	}
+
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		ex.Duration = time.Since(ex.Time)
+		ex.Error = err.Error()
+		r.write(&ex)
+		return nil, err
+	}
+
+	// 读出响应体后放回去, 调用方照常读取
+	respBody, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	ex.Duration = time.Since(ex.Time)
+	ex.Status = resp.StatusCode
+	ex.ResponseHeader = redactHeader(resp.Header)
+	ex.ResponseBody = string(respBody)
+	if readErr != nil {
+		ex.Error = readErr.Error()
+	}
+	r.write(&ex)
+	return resp, nil
+}
+
+func (r *Recorder) write(ex *Exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	ex.Seq = r.seq
+	line, err := json.Marshal(ex)
+	if err != nil {
+		return
+	}
+	r.w.Write(append(line, '\n'))
+}
+
+// redactHeader 隐去 cookie 的值, 保留名字和属性方便排查
+func redactHeader(h http.Header) http.Header {
+	if len(h) == 0 {
+		return nil
+	}
+	out := h.Clone()
+	for key, values := range out {
+		switch http.CanonicalHeaderKey(key) {
+		case "Cookie":
+			for i, v := range values {
+				values[i] = redactCookies(v, "; ")
+			}
+		case "Set-Cookie":
+			for i, v := range values {
+				parts := strings.SplitN(v, ";", 2)
+				parts[0] = redactCookies(parts[0], "")
+				values[i] = strings.Join(parts, ";")
+			}
+		case "Authorization", "Proxy-Authorization":
+			for i := range values {
+				values[i] = Redacted
+			}
+		case "Location", "Referer":
+			for i, v := range values {
+				values[i] = redactURL(v)
+			}
+		}
+	}
+	return out
+}
+
+func redactCookies(v, sep string) string {
+	var cookies []string
+	for _, c := range strings.Split(v, ";") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		name := strings.SplitN(c, "=", 2)[0]
+		cookies = append(cookies, name+"="+Redacted)
+	}
+	return strings.Join(cookies, sep)
+}
+
+// redactURL 隐去 CAS ticket, 它可以换到登录 cookie
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.RawQuery == "" {
+		return raw
+	}
+	query := u.Query()
+	if _, ok := query["ticket"]; !ok {
+		return raw
+	}
+	query.Set("ticket", Redacted)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// redactBody 隐去表单中的密码
+func redactBody(contentType string, body []byte) string {
+	if !strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		return string(body)
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return string(body)
+	}
+	for key := range form {
+		if strings.Contains(strings.ToLower(key), "password") {
+			form.Set(key, Redacted)
+		}
+	}
+	return form.Encode()
+}
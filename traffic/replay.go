@@ -0,0 +1,115 @@
+package traffic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ErrNotRecorded 表示记录中没有和请求对应的响应
+var ErrNotRecorded = errors.New("traffic: request not recorded")
+
+// Replayer 是按记录返回响应的 http.RoundTripper, 不会访问网络.
+// 请求按方法、地址和表单匹配, 每条记录只使用一次, 同样的请求按记录的顺序返回
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges []*Exchange
+	used      []bool
+}
+
+// LoadReplayer 读取 Recorder 写的 JSONL 记录
+func LoadReplayer(r io.Reader) (*Replayer, error) {
+	rp := &Replayer{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var ex Exchange
+		if err := json.Unmarshal(scanner.Bytes(), &ex); err != nil {
+			return nil, fmt.Errorf("traffic: line %d: %w", line, err)
+		}
+		rp.exchanges = append(rp.exchanges, &ex)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	rp.used = make([]bool, len(rp.exchanges))
+	return rp, nil
+}
+
+// Remaining 返回还没有被使用的记录数
+func (rp *Replayer) Remaining() int {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	n := 0
+	for _, used := range rp.used {
+		if !used {
+			n++
+		}
+	}
+	return n
+}
+
+func (rp *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		reqBody, _ = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+	}
+	rawURL := redactURL(req.URL.String())
+	body := redactBody(req.Header.Get("Content-Type"), reqBody)
+
+	ex := rp.take(req.Method, rawURL, body)
+	if ex == nil {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, rawURL, ErrNotRecorded)
+	}
+	if ex.Status == 0 {
+		return nil, fmt.Errorf("replay: %s", ex.Error)
+	}
+
+	header := ex.ResponseHeader.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+		StatusCode:    ex.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(ex.ResponseBody)),
+		ContentLength: int64(len(ex.ResponseBody)),
+		Request:       req,
+	}, nil
+}
+
+// take 先找表单也相同的记录, 没有时再找地址相同的
+func (rp *Replayer) take(method, rawURL, body string) *Exchange {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	for _, sameBody := range []bool{true, false} {
+		for i, ex := range rp.exchanges {
+			if rp.used[i] || ex.Method != method || ex.URL != rawURL {
+				continue
+			}
+			if sameBody && ex.RequestBody != body {
+				continue
+			}
+			rp.used[i] = true
+			return ex
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package traffic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"RubCourse/ehall"
+	"RubCourse/szutest"
+)
+
+const (
+	testUserId   = "2300271032"
+	testPassword = "p@ssw0rd"
+)
+
+// bookOnce 登录并查询一次场次, 返回查询结果
+func bookOnce(t *testing.T, srv *szutest.Server, transport http.RoundTripper) ([]ehall.OpenRoomData, error) {
+	t.Helper()
+	ctx := context.Background()
+	httpClient := &http.Client{Transport: transport}
+
+	casClient := srv.CASClient()
+	casClient.HTTPClient = httpClient
+	session, err := casClient.Login(ctx, testUserId, testPassword)
+	if err != nil {
+		return nil, err
+	}
+	client := srv.EhallClient(session)
+	client.HTTPClient = httpClient
+	if _, err := client.GetTimeList(ctx, "2023-09-17", ehall.Place{}); err != nil {
+		return nil, err
+	}
+	return client.GetOpeningRoom(ctx, ehall.Slot{Date: "2023-09-17", Start: "20:00", End: "21:00"}, ehall.Place{})
+}
+
+func TestRecordRedactsAndReplays(t *testing.T) {
+	srv := szutest.NewServer()
+	defer srv.Close()
+	srv.AddUser(testUserId, testPassword)
+	srv.AddCourts(szutest.Court{WID: "court-1", Name: "羽毛球场B1"})
+	srv.OpenSlot("2023-09-17", "20:00", "21:00")
+
+	var buf bytes.Buffer
+	rows, err := bookOnce(t, srv, NewRecorder(&buf, nil))
+	if err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	recorded := buf.String()
+	for _, secret := range []string{testPassword, "CAS-", "WEU-", "ST-"} {
+		if strings.Contains(recorded, secret) {
+			t.Errorf("recording contains %q:\n%s", secret, recorded)
+		}
+	}
+	if !strings.Contains(recorded, "password="+Redacted) {
+		t.Errorf("password field not redacted:\n%s", recorded)
+	}
+
+	replayer, err := LoadReplayer(strings.NewReader(recorded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 回放时服务器已经关闭
+	srv.Close()
+	replayed, err := bookOnce(t, srv, replayer)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(replayed) != 1 || replayed[0] != rows[0] {
+		t.Errorf("replayed rows = %+v, want %+v", replayed, rows)
+	}
+	if n := replayer.Remaining(); n != 0 {
+		t.Errorf("%d recorded exchanges not replayed", n)
+	}
+
+	_, err = bookOnce(t, srv, replayer)
+	if !errors.Is(err, ErrNotRecorded) {
+		t.Errorf("err = %v, want ErrNotRecorded", err)
+	}
+}
+
+func TestRecordTransportError(t *testing.T) {
+	srv := szutest.NewServer()
+	defer srv.Close()
+	srv.Inject("/authserver/login", 1, szutest.Fault{Drop: true})
+
+	var buf bytes.Buffer
+	if _, err := bookOnce(t, srv, NewRecorder(&buf, nil)); err == nil {
+		t.Fatal("expected error")
+	}
+	replayer, err := LoadReplayer(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bookOnce(t, srv, replayer); err == nil || errors.Is(err, ErrNotRecorded) {
+		t.Errorf("replayed err = %v, want recorded transport error", err)
+	}
+}